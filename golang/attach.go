@@ -0,0 +1,299 @@
+package duplex
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+/*
+Process attach
+
+An attached process is a streaming call in both directions. The
+client streams ProcessInput, starting with one that may carry the
+initial terminal size, and the handler streams ProcessOutput back,
+ending with the exit status:
+
+	-> {"resize": {"rows": 24, "cols": 80}}
+	-> {"stdin": "bHMK"}
+	<- {"stdout": "ZmlsZXMK"}
+	<- {"exit": 0}
+*/
+
+// WindowSize is the size of a terminal in characters.
+type WindowSize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// ProcessInput is streamed from an attached client to the process.
+type ProcessInput struct {
+	Stdin  []byte      `json:"stdin,omitempty"`
+	EOF    bool        `json:"eof,omitempty"`
+	Resize *WindowSize `json:"resize,omitempty"`
+}
+
+// ProcessOutput is streamed from the process to its client. The
+// last one carries the exit status.
+type ProcessOutput struct {
+	Stdout []byte `json:"stdout,omitempty"`
+	Stderr []byte `json:"stderr,omitempty"`
+	Exit   *int   `json:"exit,omitempty"`
+}
+
+var ErrPtyUnsupported = errors.New("duplex: pty not supported on this platform")
+
+// ProcessHandler returns a handler that runs the command made by
+// newCmd for each call and attaches the caller to its stdio. With
+// usePty the command runs in a new pseudo-terminal, so its output
+// all arrives as stdout and resize requests apply to it.
+func ProcessHandler(newCmd func() *exec.Cmd, usePty bool) func(*Channel) error {
+	return func(ch *Channel) error {
+		msg, err := ch.recvMsg()
+		if msg == nil {
+			return err
+		}
+		var in ProcessInput
+		if err := ch.decode(msg.Payload, &in); err != nil {
+			return ch.SendErr(ErrCodeInternal, err.Error(), nil)
+		}
+		cmd := newCmd()
+		var stdin io.WriteCloser
+		var tty *os.File
+		outputs := make(map[bool]io.Reader) // keyed by stderr
+		if usePty {
+			tty, err = startPty(cmd, in.Resize)
+			stdin, outputs[false] = tty, tty
+		} else {
+			stdin, outputs[false], outputs[true], err = startPipes(cmd)
+		}
+		if err != nil {
+			return ch.SendErr(ErrCodeInternal, err.Error(), nil)
+		}
+		if tty != nil {
+			defer tty.Close()
+		}
+		if len(in.Stdin) > 0 {
+			stdin.Write(in.Stdin)
+		}
+		if !msg.More {
+			closeStdin(stdin, tty)
+		} else {
+			go func() {
+				if err := copyInput(ch, stdin, tty); err != nil {
+					cmd.Process.Kill()
+				}
+			}()
+		}
+		var wg sync.WaitGroup
+		for stderr, r := range outputs {
+			wg.Add(1)
+			go func(stderr bool, r io.Reader) {
+				defer wg.Done()
+				copyOutput(ch, r, stderr)
+			}(stderr, r)
+		}
+		wg.Wait()
+		code := 0
+		if err := cmd.Wait(); err != nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				return ch.SendErr(ErrCodeInternal, err.Error(), nil)
+			}
+			code = exitErr.ExitCode()
+		}
+		return ch.Send(ProcessOutput{Exit: &code}, false)
+	}
+}
+
+func startPipes(cmd *exec.Cmd) (stdin io.WriteCloser, stdout, stderr io.Reader, err error) {
+	if stdin, err = cmd.StdinPipe(); err != nil {
+		return
+	}
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return
+	}
+	if stderr, err = cmd.StderrPipe(); err != nil {
+		return
+	}
+	err = cmd.Start()
+	return
+}
+
+// closeStdin ends the process's input. A pty has no way to close
+// only its input, so the terminal's EOF character is sent instead.
+func closeStdin(stdin io.WriteCloser, tty *os.File) {
+	if tty != nil {
+		tty.Write([]byte{4})
+		return
+	}
+	stdin.Close()
+}
+
+// copyInput applies ProcessInput from the client until its stream
+// ends, returning an error if it ends abnormally.
+func copyInput(ch *Channel, stdin io.WriteCloser, tty *os.File) error {
+	closed := false
+	for {
+		msg, err := ch.recvMsg()
+		if msg == nil {
+			if !closed {
+				closeStdin(stdin, tty)
+			}
+			return err
+		}
+		var in ProcessInput
+		if err := ch.decode(msg.Payload, &in); err != nil {
+			return err
+		}
+		if in.Resize != nil && tty != nil {
+			setWinsize(tty, *in.Resize)
+		}
+		if len(in.Stdin) > 0 && !closed {
+			stdin.Write(in.Stdin)
+		}
+		if (in.EOF || !msg.More) && !closed {
+			closeStdin(stdin, tty)
+			closed = true
+		}
+	}
+}
+
+func copyOutput(ch *Channel, r io.Reader, stderr bool) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			out := ProcessOutput{Stdout: buf[:n]}
+			if stderr {
+				out = ProcessOutput{Stderr: buf[:n]}
+			}
+			if ch.Send(out, true) != nil {
+				return
+			}
+		}
+		if err != nil {
+			// a pty reports EIO once the process is gone
+			return
+		}
+	}
+}
+
+// Attachment is the client side of a call to a ProcessHandler.
+type Attachment struct {
+	ch     *Channel
+	mu     sync.Mutex
+	closed bool
+}
+
+// Attach calls a ProcessHandler method on peer. A non-nil size
+// sets the initial size of its terminal.
+func Attach(peer *Peer, method string, size *WindowSize) (*Attachment, error) {
+	ch := peer.Open(method)
+	if err := ch.Send(ProcessInput{Resize: size}, true); err != nil {
+		return nil, err
+	}
+	return &Attachment{ch: ch}, nil
+}
+
+func (a *Attachment) send(in ProcessInput, more bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return io.ErrClosedPipe
+	}
+	a.closed = !more
+	return a.ch.Send(in, more)
+}
+
+// Write sends p to the process's stdin.
+func (a *Attachment) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := a.send(ProcessInput{Stdin: p}, true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseStdin closes the process's stdin.
+func (a *Attachment) CloseStdin() error {
+	return a.send(ProcessInput{EOF: true}, true)
+}
+
+// Resize changes the size of the process's terminal.
+func (a *Attachment) Resize(size WindowSize) error {
+	return a.send(ProcessInput{Resize: &size}, true)
+}
+
+// Wait copies the process's output to stdout and stderr until it
+// exits and returns its exit code.
+func (a *Attachment) Wait(stdout, stderr io.Writer) (int, error) {
+	defer a.send(ProcessInput{}, false)
+	for {
+		msg, err := a.ch.recvMsg()
+		if msg == nil {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return -1, err
+		}
+		var out ProcessOutput
+		if err := a.ch.decode(msg.Payload, &out); err != nil {
+			return -1, err
+		}
+		if len(out.Stdout) > 0 {
+			stdout.Write(out.Stdout)
+		}
+		if len(out.Stderr) > 0 {
+			stderr.Write(out.Stderr)
+		}
+		if out.Exit != nil {
+			return *out.Exit, nil
+		}
+	}
+}
+
+// AttachTerminal attaches the local terminal to a ProcessHandler
+// method on peer, in raw mode and following its size, until the
+// process exits. It returns the process's exit code.
+func AttachTerminal(peer *Peer, method string) (int, error) {
+	fd := int(os.Stdin.Fd())
+	var size *WindowSize
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return -1, err
+		}
+		defer term.Restore(fd, state)
+		size = terminalSize(fd)
+	}
+	a, err := Attach(peer, method, size)
+	if err != nil {
+		return -1, err
+	}
+	stop := notifyResize(func() {
+		if size := terminalSize(fd); size != nil {
+			a.Resize(*size)
+		}
+	})
+	defer stop()
+	go func() {
+		io.Copy(a, os.Stdin)
+		a.CloseStdin()
+	}()
+	return a.Wait(os.Stdout, os.Stderr)
+}
+
+func terminalSize(fd int) *WindowSize {
+	cols, rows, err := term.GetSize(fd)
+	if err != nil {
+		return nil
+	}
+	return &WindowSize{Rows: uint16(rows), Cols: uint16(cols)}
+}
@@ -0,0 +1,59 @@
+package duplex
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestProcessAttachPipes(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("run", ProcessHandler(func() *exec.Cmd {
+		return exec.Command("sh", "-c", `read line; echo "got $line"; echo err >&2; exit 3`)
+	}, false))
+	_, client := NewPeerPair(rpc)
+	a, err := Attach(client, "run", nil)
+	Fatal(err, t)
+	_, err = a.Write([]byte("hi\n"))
+	Fatal(err, t)
+	var stdout, stderr bytes.Buffer
+	code, err := a.Wait(&stdout, &stderr)
+	Fatal(err, t)
+	if code != 3 {
+		t.Fatal("Unexpected exit code:", code)
+	}
+	if stdout.String() != "got hi\n" {
+		t.Fatalf("Unexpected stdout: %q", stdout.String())
+	}
+	if stderr.String() != "err\n" {
+		t.Fatalf("Unexpected stderr: %q", stderr.String())
+	}
+}
+
+func TestProcessAttachPty(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("no pty support:", err)
+	}
+	rpc := NewTestRPC()
+	rpc.Register("run", ProcessHandler(func() *exec.Cmd {
+		return exec.Command("stty", "size")
+	}, true))
+	_, client := NewPeerPair(rpc)
+	a, err := Attach(client, "run", &WindowSize{Rows: 30, Cols: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	code, err := a.Wait(&stdout, &stderr)
+	if err != nil {
+		if strings.Contains(err.Error(), ErrPtyUnsupported.Error()) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	if code != 0 || strings.TrimSpace(stdout.String()) != "30 100" {
+		t.Fatalf("Unexpected result %d: %q", code, stdout.String())
+	}
+}
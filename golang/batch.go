@@ -0,0 +1,168 @@
+package duplex
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+/*
+Batching
+
+With the batch feature negotiated, a peer may coalesce the
+messages it sends within a short window into one frame, saving
+a transport write and frame per message on chatty streams. A
+batch is a message carrying the others, in order, as its payload:
+
+	{"type": "batch", "payload": [
+		{"type": "req", "method": "log", "id": 3, "payload": "a", "more": true},
+		{"type": "req", "method": "log", "id": 3, "payload": "b", "more": true},
+		{"type": "cred", "method": "rep", "id": 2, "payload": 32}]}
+
+The receiver routes a batch's messages as if they had arrived in
+frames of their own. Clients ask for the feature when they batch,
+and servers always accept it, batching their own messages only
+when they're set to. A window holding a single message is sent
+as a plain frame.
+*/
+
+// batchOverhead is room left in a frame for wrapping its batch.
+const batchOverhead = 64
+
+// SetBatching coalesces the messages sent within window into one
+// frame, sending early once size bytes are pending. A size of zero
+// fills frames up to MaxFrameSize, and a window of zero turns
+// batching off. It applies to connections made after the call,
+// with remotes that support batching, and needs a codec that can
+// join frames.
+func (rpc *RPC) SetBatching(window time.Duration, size int) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.batchWindow, rpc.batchSize = window, size
+}
+
+// joinJSON wraps JSON encoded messages in a batch without decoding
+// them again.
+func joinJSON(frames [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"type":`)
+	typ, err := json.Marshal(TypeBatch)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(typ)
+	buf.WriteString(`,"payload":[`)
+	buf.Write(bytes.Join(frames, []byte(",")))
+	buf.WriteString(`]}`)
+	return buf.Bytes(), nil
+}
+
+// batcher holds encoded messages until their window passes or they
+// fill the size budget, then writes them as one frame.
+type batcher struct {
+	peer   *Peer
+	join   func([][]byte) ([]byte, error)
+	window time.Duration
+	size   int
+
+	mu      sync.Mutex
+	frames  [][]byte
+	pending int // bytes in frames, with a separator each
+	timer   *time.Timer
+}
+
+func newBatcher(peer *Peer, join func([][]byte) ([]byte, error), window time.Duration, size int) *batcher {
+	if size <= 0 || size > MaxFrameSize-batchOverhead {
+		size = MaxFrameSize - batchOverhead
+	}
+	return &batcher{peer: peer, join: join, window: window, size: size}
+}
+
+// add queues an encoded message, writing the batch if it's full.
+// Frames too big to share are written alone, after those queued.
+func (b *batcher) add(frame []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending+len(frame)+1 > b.size {
+		if err := b.flushLocked(); err != nil {
+			return err
+		}
+		if len(frame)+1 > b.size {
+			return b.peer.writeFrame(frame)
+		}
+	}
+	b.frames = append(b.frames, frame)
+	b.pending += len(frame) + 1
+	if b.pending >= b.size {
+		return b.flushLocked()
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	return nil
+}
+
+// flush writes the queued messages when the window passes. A
+// failed write means the connection is broken, so the peer is
+// closed.
+func (b *batcher) flush() {
+	b.mu.Lock()
+	err := b.flushLocked()
+	b.mu.Unlock()
+	if err != nil {
+		b.peer.log().Error("unable to write batch", "err", err)
+		b.peer.Close()
+	}
+}
+
+// flushLocked writes the queued messages. mu must be held, which
+// keeps writes in order.
+func (b *batcher) flushLocked() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	frames := b.frames
+	b.frames, b.pending = nil, 0
+	switch len(frames) {
+	case 0:
+		return nil
+	case 1:
+		return b.peer.writeFrame(frames[0])
+	}
+	frame, err := b.join(frames)
+	if err != nil {
+		return err
+	}
+	return b.peer.writeFrame(frame)
+}
+
+// drain writes whatever is queued, as the peer closes.
+func (b *batcher) drain() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+// unbatch routes the messages of a batch frame.
+func (peer *Peer) unbatch(frame []byte) {
+	var batch struct {
+		Payload []*Message `json:"payload"`
+	}
+	if err := peer.rpc.codec.Decode(frame, &batch); err != nil {
+		peer.log().Error("protocol error: undecodable batch",
+			"size", len(frame), "err", err)
+		return
+	}
+	for _, msg := range batch.Payload {
+		if msg == nil || msg.Type == TypeBatch {
+			peer.log().Error("protocol error: bad message in batch")
+			continue
+		}
+		if peer.logFrames {
+			peer.logFrame("recv", msg, 0)
+		}
+		peer.routeMsg(msg)
+	}
+}
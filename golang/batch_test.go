@@ -0,0 +1,96 @@
+package duplex
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeNegotiatesBatch(t *testing.T) {
+	conn := NewMockConn()
+	defer conn.Close()
+	rpc := NewTestRPC()
+	rpc.SetBatching(time.Millisecond, 0)
+	conn.inbox <- HandshakeAccept + ";batch"
+	peer, err := rpc.Handshake(conn)
+	Fatal(err, t)
+	if conn.sent[0].String() != Handshake("json")+";batch" {
+		t.Fatal("Unexpected handshake frame:", conn.sent[0].String())
+	}
+	if peer.batch == nil {
+		t.Fatal("Expected batching to be negotiated")
+	}
+}
+
+func TestUnbatch(t *testing.T) {
+	conn := NewMockConn()
+	defer conn.Close()
+	rpc := NewTestRPC()
+	rpc.Register("echo", Echo)
+	conn.inbox <- Handshake("json") + ";batch"
+	peer, err := rpc.Accept(conn)
+	Fatal(err, t)
+	if conn.sent[0].String() != HandshakeAccept+";batch" || peer.batch != nil {
+		t.Fatal("Unexpected handshake response frame:", conn.sent[0].String())
+	}
+	conn.ExpectWrites(2)
+	conn.inbox <- `{"type":"batch","payload":[` +
+		`{"type":"req","method":"echo","id":1,"payload":"a"},` +
+		`{"type":"req","method":"echo","id":2,"payload":"b"}]}`
+	conn.writes.Wait()
+	conn.Lock()
+	defer conn.Unlock()
+	replies := conn.sent[1].String() + conn.sent[2].String()
+	if !strings.Contains(replies, `"id":1}`) || !strings.Contains(replies, `"id":2}`) {
+		t.Fatal("Unexpected replies:", replies)
+	}
+}
+
+func TestBatchCoalescesStream(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetBatching(20*time.Millisecond, 0)
+	rpc.Register("sum", func(ch *Channel) error {
+		var sum, n float64
+		for {
+			more, err := ch.Recv(&n)
+			if err != nil {
+				return err
+			}
+			sum += n
+			if !more {
+				return ch.Send(sum, false)
+			}
+		}
+	})
+	_, client, _, conn := NewPeerPairConns(rpc)
+
+	ch := client.Open("sum")
+	for i := 1; i <= 10; i++ {
+		Fatal(ch.Send(i, i < 10), t)
+	}
+	var sum float64
+	_, err := ch.Recv(&sum)
+	Fatal(err, t)
+	if sum != 55 {
+		t.Fatal("Unexpected sum:", sum)
+	}
+	conn.Lock()
+	defer conn.Unlock()
+	// the handshake and a single batch
+	if len(conn.sent) != 2 || !strings.HasPrefix(conn.sent[1].String(), `{"type":"batch"`) {
+		t.Fatal("Expected stream in one batch, got frames:", len(conn.sent))
+	}
+}
+
+func TestBatchSendsLargeFramesAlone(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetBatching(time.Hour, 64)
+	rpc.Register("echo", Echo)
+	_, client := NewPeerPair(rpc)
+	large := strings.Repeat("x", 200)
+	var reply string
+	Fatal(client.Call("echo", large, &reply), t)
+	if reply != large {
+		t.Fatal("Unexpected reply:", reply)
+	}
+}
@@ -0,0 +1,296 @@
+package duplex
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+/*
+Circuit breaking
+
+CircuitBreaker is call middleware that stops calling a method on
+a peer that keeps failing, so callers fail fast instead of piling
+up behind it. Each peer and method has its own circuit:
+
+	closed     calls go through; enough failures in a row open it
+	open       calls fail with ErrCodeCircuitOpen until the cool
+	           down passes
+	half-open  a few probe calls go through; if they succeed the
+	           circuit closes, if one fails it opens again
+
+Failures are errors that say the remote is unwell rather than
+that the call was wrong: the peer closing, timeouts, refusals
+and internal errors.
+*/
+
+// ErrCodeCircuitOpen is returned for calls refused by an open
+// circuit. The error's data holds the milliseconds until the
+// circuit is next tried as "retryAfter".
+const ErrCodeCircuitOpen = -32003
+
+// CircuitState is the state of a circuit.
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// BreakerConfig configures a CircuitBreaker. Zero fields take
+// their defaults.
+type BreakerConfig struct {
+	// Failures in a row that open a circuit, 5 by default.
+	FailureThreshold int
+	// How long a circuit stays open, 5s by default.
+	CoolDown time.Duration
+	// Successful probes that close a half-open circuit, and the
+	// most that run at once, 1 by default.
+	Probes int
+	// IsFailure decides which errors count as failures.
+	IsFailure func(error) bool
+}
+
+// CircuitEvent reports a circuit changing state. Peer is nil for
+// calls made on a PeerPool.
+type CircuitEvent struct {
+	Peer     *Peer
+	Method   string
+	From, To CircuitState
+}
+
+type circuitKey struct {
+	peer   *Peer
+	method string
+}
+
+type circuit struct {
+	state     CircuitState
+	failures  int
+	successes int
+	probing   int
+	openedAt  time.Time
+}
+
+// CircuitBreaker tracks circuits per peer and method.
+type CircuitBreaker struct {
+	config BreakerConfig
+
+	mu       sync.Mutex
+	circuits map[circuitKey]*circuit
+	peers    map[*Peer]bool // peers watched for closing
+	onChange func(CircuitEvent)
+}
+
+func NewCircuitBreaker(config BreakerConfig) *CircuitBreaker {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 5
+	}
+	if config.CoolDown <= 0 {
+		config.CoolDown = 5 * time.Second
+	}
+	if config.Probes <= 0 {
+		config.Probes = 1
+	}
+	if config.IsFailure == nil {
+		config.IsFailure = isFailure
+	}
+	return &CircuitBreaker{
+		config:   config,
+		circuits: make(map[circuitKey]*circuit),
+		peers:    make(map[*Peer]bool),
+	}
+}
+
+func isFailure(err error) bool {
+	var rpcError *Error
+	if errors.As(err, &rpcError) {
+		switch rpcError.Code {
+		case ErrCodeInternal, ErrCodeBusy, ErrCodeShuttingDown:
+			return true
+		}
+		return false
+	}
+	return errors.Is(err, ErrPeerClosed) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// OnStateChange sets a function called whenever a circuit changes
+// state. It's called outside the breaker's lock.
+func (b *CircuitBreaker) OnStateChange(fn func(CircuitEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onChange = fn
+}
+
+// State returns the state of the circuit for method on peer.
+func (b *CircuitBreaker) State(peer *Peer, method string) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c := b.circuits[circuitKey{peer, method}]; c != nil {
+		if c.state == CircuitOpen && time.Since(c.openedAt) >= b.config.CoolDown {
+			return CircuitHalfOpen
+		}
+		return c.state
+	}
+	return CircuitClosed
+}
+
+// Middleware is the CallMiddleware applying the breaker.
+func (b *CircuitBreaker) Middleware(next Invoker) Invoker {
+	return func(ctx context.Context, method string, args interface{}, reply interface{}) error {
+		key := circuitKey{ContextPeer(ctx), method}
+		probe, err := b.allow(key)
+		if err != nil {
+			return err
+		}
+		err = next(ctx, method, args, reply)
+		if ctx.Err() == context.Canceled {
+			// the caller gave up, which says nothing of the remote
+			b.record(key, probe, nil, true)
+			return err
+		}
+		b.record(key, probe, err, false)
+		return err
+	}
+}
+
+// allow admits a call, reporting whether it's a probe of a
+// half-open circuit, or returns the error refusing it.
+func (b *CircuitBreaker) allow(key circuitKey) (bool, error) {
+	b.mu.Lock()
+	c := b.circuits[key]
+	if c == nil {
+		c = &circuit{}
+		b.circuits[key] = c
+		if key.peer != nil && !b.peers[key.peer] {
+			b.peers[key.peer] = true
+			go b.forget(key.peer)
+		}
+	}
+	var event *CircuitEvent
+	if c.state == CircuitOpen {
+		wait := b.config.CoolDown - time.Since(c.openedAt)
+		if wait > 0 {
+			b.mu.Unlock()
+			return false, &Error{
+				Code:    ErrCodeCircuitOpen,
+				Message: "circuit open: " + key.method,
+				Data:    map[string]interface{}{"retryAfter": ceilMilliseconds(wait)},
+			}
+		}
+		event = b.transition(key, c, CircuitHalfOpen)
+	}
+	if c.state == CircuitHalfOpen {
+		if c.probing >= b.config.Probes {
+			b.mu.Unlock()
+			b.notify(event)
+			return false, &Error{Code: ErrCodeCircuitOpen, Message: "circuit half-open: " + key.method}
+		}
+		c.probing++
+		b.mu.Unlock()
+		b.notify(event)
+		return true, nil
+	}
+	b.mu.Unlock()
+	b.notify(event)
+	return false, nil
+}
+
+// record updates a circuit with the outcome of a call it allowed,
+// probe saying whether allow admitted it as a probe. A probe always
+// gives back its slot, but an outcome only counts if the circuit is
+// still in the state the call was admitted in, so a slow call can't
+// settle a circuit that has moved on. An ignored call only gives
+// back its probe.
+func (b *CircuitBreaker) record(key circuitKey, probe bool, err error, ignore bool) {
+	b.mu.Lock()
+	c := b.circuits[key]
+	if c == nil {
+		b.mu.Unlock()
+		return
+	}
+	admitted := CircuitClosed
+	if probe {
+		// the circuit may have been forgotten and made anew
+		c.probing = max(0, c.probing-1)
+		admitted = CircuitHalfOpen
+	}
+	var event *CircuitEvent
+	switch {
+	case ignore || c.state != admitted:
+	case err != nil && b.config.IsFailure(err):
+		c.failures++
+		if probe || c.failures >= b.config.FailureThreshold {
+			event = b.transition(key, c, CircuitOpen)
+		}
+	default:
+		c.failures = 0
+		if probe {
+			c.successes++
+			if c.successes >= b.config.Probes {
+				event = b.transition(key, c, CircuitClosed)
+			}
+		}
+	}
+	b.mu.Unlock()
+	b.notify(event)
+}
+
+// ceilMilliseconds rounds d up to whole milliseconds, so a short
+// wait isn't reported as none.
+func ceilMilliseconds(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// transition moves a circuit to a new state, returning the event
+// to report. mu must be held.
+func (b *CircuitBreaker) transition(key circuitKey, c *circuit, to CircuitState) *CircuitEvent {
+	event := &CircuitEvent{Peer: key.peer, Method: key.method, From: c.state, To: to}
+	c.state = to
+	c.failures, c.successes = 0, 0
+	if to == CircuitOpen {
+		c.openedAt = time.Now()
+	}
+	if b.onChange == nil {
+		return nil
+	}
+	return event
+}
+
+func (b *CircuitBreaker) notify(event *CircuitEvent) {
+	if event == nil {
+		return
+	}
+	b.mu.Lock()
+	fn := b.onChange
+	b.mu.Unlock()
+	if fn != nil {
+		fn(*event)
+	}
+}
+
+// forget drops a peer's circuits once it closes.
+func (b *CircuitBreaker) forget(peer *Peer) {
+	<-peer.Done()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key := range b.circuits {
+		if key.peer == peer {
+			delete(b.circuits, key)
+		}
+	}
+	delete(b.peers, peer)
+}
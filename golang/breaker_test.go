@@ -0,0 +1,185 @@
+package duplex
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func errorCode(err error) int {
+	if rpcError, ok := err.(*Error); ok {
+		return rpcError.Code
+	}
+	return 0
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	rpc := NewTestRPC()
+	calls := flaky(rpc, "status", 2)
+	breaker := NewCircuitBreaker(BreakerConfig{FailureThreshold: 2, CoolDown: 50 * time.Millisecond})
+	var mu sync.Mutex
+	var events []CircuitEvent
+	breaker.OnStateChange(func(event CircuitEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	})
+	_, client := NewPeerPair(rpc)
+	client.UseCall(breaker.Middleware)
+
+	for i := 0; i < 2; i++ {
+		if err := client.Call("status", "ok", new(string)); err == nil {
+			t.Fatal("Expected busy error")
+		}
+	}
+	if state := breaker.State(client, "status"); state != CircuitOpen {
+		t.Fatal("Expected open circuit, got:", state)
+	}
+	err := client.Call("status", "ok", new(string))
+	rpcError, ok := err.(*Error)
+	if !ok || rpcError.Code != ErrCodeCircuitOpen {
+		t.Fatal("Expected circuit open error, got:", err)
+	}
+	if _, ok := rpcError.Data.(map[string]interface{})["retryAfter"]; !ok {
+		t.Fatal("Expected retryAfter in error data:", rpcError.Data)
+	}
+	if calls.Load() != 2 {
+		t.Fatal("Open circuit let a call through:", calls.Load())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if state := breaker.State(client, "status"); state != CircuitHalfOpen {
+		t.Fatal("Expected half-open circuit, got:", state)
+	}
+	var reply string
+	Fatal(client.Call("status", "ok", &reply), t)
+	if reply != "ok" || breaker.State(client, "status") != CircuitClosed {
+		t.Fatal("Expected probe to close circuit:", reply, breaker.State(client, "status"))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if len(events) != len(expected) {
+		t.Fatal("Unexpected events:", events)
+	}
+	for i, event := range events {
+		if event.To != expected[i] || event.Peer != client || event.Method != "status" {
+			t.Fatal("Unexpected event:", event)
+		}
+	}
+}
+
+func TestCircuitBreakerFailedProbeReopens(t *testing.T) {
+	rpc := NewTestRPC()
+	flaky(rpc, "status", 5)
+	breaker := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, CoolDown: 20 * time.Millisecond})
+	_, client := NewPeerPair(rpc)
+	client.UseCall(breaker.Middleware)
+	client.Call("status", "ok", new(string))
+	time.Sleep(30 * time.Millisecond)
+	if err := client.Call("status", "ok", new(string)); errorCode(err) != ErrCodeBusy {
+		t.Fatal("Expected probe to reach handler, got:", err)
+	}
+	if state := breaker.State(client, "status"); state != CircuitOpen {
+		t.Fatal("Expected failed probe to reopen circuit, got:", state)
+	}
+}
+
+func TestCircuitBreakerPerPeerAndMethod(t *testing.T) {
+	rpc := NewTestRPC()
+	flaky(rpc, "status", 5)
+	rpc.Register("echo", Echo)
+	breaker := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, CoolDown: time.Minute})
+	rpc.UseCall(breaker.Middleware)
+	_, client1 := NewPeerPair(rpc)
+	_, client2 := NewPeerPair(rpc)
+
+	client1.Call("status", "ok", new(string))
+	if err := client1.Call("status", "ok", new(string)); errorCode(err) != ErrCodeCircuitOpen {
+		t.Fatal("Expected circuit open error, got:", err)
+	}
+	Fatal(client1.Call("echo", "ok", new(string)), t)
+	if err := client2.Call("status", "ok", new(string)); errorCode(err) != ErrCodeBusy {
+		t.Fatal("Expected other peer's circuit closed, got:", err)
+	}
+}
+
+func TestPoolSkipsOpenCircuit(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("echo", Echo)
+	breaker := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, CoolDown: time.Minute})
+	rpc.UseCall(breaker.Middleware)
+	_, client1 := NewPeerPair(rpc)
+	_, client2 := NewPeerPair(rpc)
+	// trip client1's circuit
+	key := circuitKey{client1, "echo"}
+	probe, err := breaker.allow(key)
+	Fatal(err, t)
+	breaker.record(key, probe, &Error{Code: ErrCodeBusy}, false)
+
+	pool := NewPeerPool(RoundRobin)
+	pool.Add(client1)
+	pool.Add(client2)
+	for i := 0; i < 4; i++ {
+		var reply string
+		Fatal(pool.Call("echo", "ok", &reply), t)
+	}
+}
+
+func TestCircuitBreakerCountsCallsByAdmission(t *testing.T) {
+	breaker := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, CoolDown: 10 * time.Millisecond, Probes: 2})
+	key := circuitKey{nil, "status"}
+	allow := func() bool {
+		probe, err := breaker.allow(key)
+		Fatal(err, t)
+		return probe
+	}
+	slow := allow()
+	breaker.record(key, allow(), &Error{Code: ErrCodeBusy}, false)
+	time.Sleep(15 * time.Millisecond)
+	probe1, probe2 := allow(), allow()
+	if slow || !probe1 || !probe2 {
+		t.Fatal("Unexpected probes:", slow, probe1, probe2)
+	}
+	if _, err := breaker.allow(key); errorCode(err) != ErrCodeCircuitOpen {
+		t.Fatal("Expected probes to be limited, got:", err)
+	}
+	// a call admitted while closed says nothing about the probes
+	breaker.record(key, slow, nil, false)
+	if state := breaker.State(nil, "status"); state != CircuitHalfOpen {
+		t.Fatal("Slow call settled the circuit:", state)
+	}
+	if _, err := breaker.allow(key); errorCode(err) != ErrCodeCircuitOpen {
+		t.Fatal("Slow call freed a probe, got:", err)
+	}
+	// a probe finishing after a sibling reopened the circuit still
+	// gives back its slot
+	breaker.record(key, probe1, &Error{Code: ErrCodeBusy}, false)
+	breaker.record(key, probe2, nil, false)
+	if state := breaker.State(nil, "status"); state != CircuitOpen {
+		t.Fatal("Expected failed probe to reopen circuit, got:", state)
+	}
+	time.Sleep(15 * time.Millisecond)
+	breaker.record(key, allow(), nil, false)
+	breaker.record(key, allow(), nil, false)
+	if state := breaker.State(nil, "status"); state != CircuitClosed {
+		t.Fatal("Expected probes to close circuit, got:", state)
+	}
+}
+
+func TestCircuitOpenRetryAfterRoundsUp(t *testing.T) {
+	breaker := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, CoolDown: time.Millisecond})
+	key := circuitKey{nil, "status"}
+	probe, err := breaker.allow(key)
+	Fatal(err, t)
+	breaker.record(key, probe, &Error{Code: ErrCodeBusy}, false)
+	_, err = breaker.allow(key)
+	if errorCode(err) != ErrCodeCircuitOpen {
+		// the cool down already passed
+		return
+	}
+	if retryAfter := err.(*Error).Data.(map[string]interface{})["retryAfter"]; retryAfter != int64(1) {
+		t.Fatal("Expected retryAfter rounded up to 1, got:", retryAfter)
+	}
+}
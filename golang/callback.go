@@ -0,0 +1,106 @@
+package duplex
+
+import (
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+/*
+Callbacks
+
+A callback is a method registered on a single peer under a
+generated name, which is passed to the remote so it can call
+back:
+
+	-> {"method": "subscribe", "payload": "_callback.8b1d..."}
+	<- {"method": "_callback.8b1d...", "payload": "event"}
+
+Only that peer can call it, and it's removed when the peer
+closes, when it's revoked, or once its uses or time to live
+run out.
+*/
+
+// Callback is a method registered on one peer with Peer.Callback.
+type Callback struct {
+	Name string
+
+	peer  *Peer
+	fn    func(*Channel) error
+	uses  int // remaining calls, unlimited when 0
+	ttl   time.Duration
+	timer *time.Timer
+}
+
+type CallbackOption func(*Callback)
+
+// CallbackUses revokes a callback after it has been called n times.
+func CallbackUses(n int) CallbackOption {
+	return func(cb *Callback) {
+		cb.uses = n
+	}
+}
+
+// CallbackTTL revokes a callback once d has passed.
+func CallbackTTL(d time.Duration) CallbackOption {
+	return func(cb *Callback) {
+		cb.ttl = d
+	}
+}
+
+// Callback registers fn on this peer under a new name, available
+// as the Name of the returned Callback, until it's revoked or the
+// peer closes.
+func (peer *Peer) Callback(fn func(interface{}, *Channel) (interface{}, error), opts ...CallbackOption) *Callback {
+	cb := &Callback{
+		Name: "_callback." + uuid.New(),
+		peer: peer,
+		fn:   funcHandler(fn),
+	}
+	for _, opt := range opts {
+		opt(cb)
+	}
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.closeErr != nil {
+		return cb
+	}
+	peer.callbacks[cb.Name] = cb
+	if cb.ttl > 0 {
+		cb.timer = time.AfterFunc(cb.ttl, cb.Revoke)
+	}
+	return cb
+}
+
+// Revoke unregisters the callback. Calls already running finish.
+func (cb *Callback) Revoke() {
+	cb.peer.mu.Lock()
+	defer cb.peer.mu.Unlock()
+	cb.peer.dropCallback(cb)
+}
+
+// callback returns the handler for a callback and counts the use,
+// or nil if there's no such callback. mu must be held.
+func (peer *Peer) callback(name string) func(*Channel) error {
+	cb, exists := peer.callbacks[name]
+	if !exists {
+		return nil
+	}
+	if cb.uses > 0 {
+		cb.uses--
+		if cb.uses == 0 {
+			peer.dropCallback(cb)
+		}
+	}
+	return cb.fn
+}
+
+// dropCallback removes a callback. mu must be held.
+func (peer *Peer) dropCallback(cb *Callback) {
+	if peer.callbacks[cb.Name] == cb {
+		delete(peer.callbacks, cb.Name)
+	}
+	if cb.timer != nil {
+		cb.timer.Stop()
+	}
+}
@@ -0,0 +1,75 @@
+package duplex
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func upper(args interface{}, _ *Channel) (interface{}, error) {
+	return strings.ToUpper(args.(string)), nil
+}
+
+func expectMethodNotFound(t *testing.T, err error) {
+	t.Helper()
+	if rpcError, ok := err.(*Error); !ok || rpcError.Code != ErrCodeMethodNotFound {
+		t.Fatal("Expected method not found, got:", err)
+	}
+}
+
+func TestCallbackScopedToPeer(t *testing.T) {
+	rpc := NewTestRPC()
+	server, client := NewPeerPair(rpc)
+	cb := client.Callback(upper)
+	var reply string
+	Fatal(server.Call(cb.Name, "hello", &reply), t)
+	if reply != "HELLO" {
+		t.Fatal("Unexpected reply:", reply)
+	}
+	_, remote := NewPeerPair(rpc)
+	expectMethodNotFound(t, remote.Call(cb.Name, "hello", &reply))
+}
+
+func TestCallbackUses(t *testing.T) {
+	rpc := NewTestRPC()
+	server, client := NewPeerPair(rpc)
+	cb := client.Callback(upper, CallbackUses(2))
+	var reply string
+	Fatal(server.Call(cb.Name, "a", &reply), t)
+	Fatal(server.Call(cb.Name, "b", &reply), t)
+	expectMethodNotFound(t, server.Call(cb.Name, "c", &reply))
+}
+
+func TestCallbackTTLAndRevoke(t *testing.T) {
+	rpc := NewTestRPC()
+	server, client := NewPeerPair(rpc)
+	// long enough to outlast the first call, short enough for
+	// waitFor to see it expire
+	expiring := client.Callback(upper, CallbackTTL(250*time.Millisecond))
+	revoked := client.Callback(upper)
+	var reply string
+	Fatal(server.Call(expiring.Name, "a", &reply), t)
+	Fatal(server.Call(revoked.Name, "a", &reply), t)
+	revoked.Revoke()
+	expectMethodNotFound(t, server.Call(revoked.Name, "a", &reply))
+	waitFor(t, func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.callbacks[expiring.Name] == nil
+	})
+	expectMethodNotFound(t, server.Call(expiring.Name, "a", &reply))
+}
+
+func TestCallbacksRemovedOnClose(t *testing.T) {
+	rpc := NewTestRPC()
+	_, client := NewPeerPair(rpc)
+	client.Callback(upper)
+	client.Callback(upper, CallbackTTL(time.Hour))
+	client.Close()
+	<-client.Done()
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.callbacks) != 0 {
+		t.Fatal("Callbacks left after close:", len(client.callbacks))
+	}
+}
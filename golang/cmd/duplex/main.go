@@ -0,0 +1,292 @@
+// Command duplex is a command line client for Duplex RPC services.
+//
+//	duplex [flags] <address> methods
+//	duplex [flags] <address> call <method> [json args]
+//	duplex [flags] <address> serve
+//
+// Addresses name the transport:
+//
+//	tcp://host:port
+//	unix:///path/to/socket
+//	ws://host:port/path (or wss://)
+//	exec:command arg ...
+//
+// Stream transports are framed with -framing. Methods named with
+// -echo are registered locally, printing and echoing their calls,
+// so services can call back while a call runs or while serving.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/progrium/duplex/golang"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+type methodList []string
+
+func (l *methodList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *methodList) Set(name string) error {
+	*l = append(*l, name)
+	return nil
+}
+
+var (
+	framing = flag.String("framing", "line", "framing for stream transports: line or length")
+	codec   = flag.String("codec", "json", "payload codec")
+	timeout = flag.Duration("timeout", 0, "give up on calls after this long")
+	origin  = flag.String("origin", "http://localhost/", "origin for WebSocket connections")
+	echoes  methodList
+)
+
+func init() {
+	flag.Var(&echoes, "echo", "register a local `method` that echoes its calls (repeatable)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: duplex [flags] <address> methods|call <method> [args]|serve")
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(args[0], args[1], args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "duplex:", err)
+		os.Exit(1)
+	}
+}
+
+func run(address, command string, args []string) error {
+	rpc, err := newRPC(*codec)
+	if err != nil {
+		return err
+	}
+	conn, err := dial(address, *framing, *origin)
+	if err != nil {
+		return err
+	}
+	peer, err := rpc.Handshake(conn)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+	for _, method := range echoes {
+		peer.Register(method, echo)
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	switch command {
+	case "methods":
+		return listMethods(ctx, peer)
+	case "call":
+		if len(args) < 1 {
+			return errors.New("call needs a method")
+		}
+		return call(ctx, peer, args[0], args[1:])
+	case "serve":
+		select {
+		case <-peer.Done():
+			return peer.Err()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+func newRPC(name string) (*duplex.RPC, error) {
+	switch name {
+	case "json":
+		return duplex.NewRPC(duplex.NewJSONCodec()), nil
+	}
+	return nil, fmt.Errorf("unsupported codec %q", name)
+}
+
+// dial connects to address, framing stream transports.
+func dial(address, framing, origin string) (io.ReadWriteCloser, error) {
+	var frame func(io.ReadWriteCloser) io.ReadWriteCloser
+	switch framing {
+	case "line":
+		frame = duplex.LineFramed
+	case "length":
+		frame = duplex.LengthFramed
+	default:
+		return nil, fmt.Errorf("unknown framing %q", framing)
+	}
+	if command, ok := strings.CutPrefix(address, "exec:"); ok {
+		conn, err := spawn(strings.Fields(command))
+		if err != nil {
+			return nil, err
+		}
+		return frame(conn), nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tcp":
+		conn, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return frame(conn), nil
+	case "unix":
+		conn, err := net.Dial("unix", u.Path)
+		if err != nil {
+			return nil, err
+		}
+		return frame(conn), nil
+	case "ws", "wss":
+		// WebSocket messages are frames already
+		return websocket.Dial(address, "", origin)
+	}
+	return nil, fmt.Errorf("unsupported address %q", address)
+}
+
+// processConn talks to a subprocess over its stdin and stdout.
+type processConn struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func spawn(argv []string) (*processConn, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("exec: needs a command")
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &processConn{Reader: stdout, WriteCloser: stdin, cmd: cmd}, nil
+}
+
+func (c *processConn) Close() error {
+	c.WriteCloser.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		c.cmd.Process.Kill()
+		return <-done
+	}
+}
+
+func listMethods(ctx context.Context, peer *duplex.Peer) error {
+	methods, err := peer.RemoteMethods(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, info := range methods {
+		var flags []string
+		if info.StreamArgs {
+			flags = append(flags, "stream-args")
+		}
+		if info.StreamReply {
+			flags = append(flags, "stream-reply")
+		}
+		if info.Idempotent {
+			flags = append(flags, "idempotent")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", info.Name, strings.Join(flags, ","), info.Doc)
+	}
+	return w.Flush()
+}
+
+// call sends args, parsed as JSON, and prints each reply until the
+// last. Several args are sent as a stream.
+func call(ctx context.Context, peer *duplex.Peer, method string, args []string) error {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		if err := json.Unmarshal([]byte(arg), &values[i]); err != nil {
+			return fmt.Errorf("args must be JSON: %w", err)
+		}
+	}
+	if len(values) == 0 {
+		values = []interface{}{nil}
+	}
+	ch := peer.Open(method)
+	for i, value := range values {
+		if err := ch.Send(value, i < len(values)-1); err != nil {
+			return err
+		}
+	}
+	replies := make(chan error, 1)
+	go func() {
+		for reply, err := range duplex.Stream[interface{}](ch) {
+			if err != nil {
+				replies <- err
+				return
+			}
+			printJSON(os.Stdout, reply)
+		}
+		replies <- nil
+	}()
+	select {
+	case err := <-replies:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func echo(ch *duplex.Channel) error {
+	for value, err := range duplex.Stream[interface{}](ch) {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%s: ", ch.Method())
+		printJSON(os.Stderr, value)
+		if err := ch.Send(value, true); err != nil {
+			return err
+		}
+	}
+	return ch.Send(nil, false)
+}
+
+func printJSON(w io.Writer, v interface{}) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintln(w, v)
+		return
+	}
+	fmt.Fprintln(w, string(out))
+}
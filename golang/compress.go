@@ -0,0 +1,193 @@
+package duplex
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+/*
+Compression
+
+With the compress feature negotiated, frames of at least a set
+size are compressed before they're written. A compressed frame
+is a message carrying the compressed bytes of the frame it
+replaces, encoded by the codec so it suits the transport as any
+other frame does:
+
+	{"type": "zip", "payload": "jJBBCsIwEEX3OcXQdS..."}
+
+The client lists the algorithms it can use, best first, and the
+server answers with the one it picked, used in both directions:
+
+	SIMPLEX/1.0;json;compress=deflate
+	+OK;compress=deflate
+
+Servers accept deflate even when they don't compress their own
+frames. Compression applies to whole frames, batches included,
+after encoding, so handlers never see it.
+*/
+
+// Compressor is a compression algorithm, known by its name in the
+// handshake.
+type Compressor struct {
+	Name       string
+	Compress   func(frame []byte) ([]byte, error)
+	Decompress func(data []byte) ([]byte, error)
+}
+
+// Deflate compresses with the stdlib's deflate at its default
+// level.
+var Deflate = NewDeflateCompressor(flate.DefaultCompression)
+
+// NewDeflateCompressor returns deflate compressing at level, such
+// as flate.BestSpeed for a faster algorithm. Any level reads the
+// frames of any other. Frames expanding past MaxFrameSize fail
+// with ErrFrameTooLarge.
+func NewDeflateCompressor(level int) *Compressor {
+	writers := sync.Pool{New: func() any {
+		w, err := flate.NewWriter(nil, level)
+		if err != nil {
+			panic(err)
+		}
+		return w
+	}}
+	return &Compressor{
+		Name: "deflate",
+		Compress: func(frame []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			w := writers.Get().(*flate.Writer)
+			defer writers.Put(w)
+			w.Reset(&buf)
+			if _, err := w.Write(frame); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		Decompress: func(data []byte) ([]byte, error) {
+			r := flate.NewReader(bytes.NewReader(data))
+			defer r.Close()
+			frame, err := io.ReadAll(io.LimitReader(r, int64(MaxFrameSize)+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(frame) > MaxFrameSize {
+				return nil, ErrFrameTooLarge
+			}
+			return frame, nil
+		},
+	}
+}
+
+// SetCompression compresses frames of at least threshold bytes
+// for connections made after the call, with the first of
+// compressors the remote supports, or Deflate if none are given.
+// A threshold of zero turns compression off.
+func (rpc *RPC) SetCompression(threshold int, compressors ...*Compressor) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	if len(compressors) == 0 {
+		compressors = []*Compressor{Deflate}
+	}
+	rpc.compressMin, rpc.compressors = threshold, compressors
+}
+
+// compressor finds the algorithm named name. rpc must be locked.
+func (rpc *RPC) compressor(name string) *Compressor {
+	for _, c := range rpc.compressors {
+		if c.Name == name {
+			return c
+		}
+	}
+	if name == Deflate.Name {
+		return Deflate
+	}
+	return nil
+}
+
+// compressorNames lists the algorithms a client offers. rpc must
+// be locked.
+func (rpc *RPC) compressorNames() string {
+	var names []string
+	for _, c := range rpc.compressors {
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, "+")
+}
+
+// pickCompressor chooses the first offered algorithm the server
+// knows. rpc must be locked.
+func (rpc *RPC) pickCompressor(offered string) string {
+	for _, name := range strings.Split(offered, "+") {
+		if rpc.compressor(name) != nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// negotiateCompression uses the one algorithm named by both sides,
+// the server having answered with a single name.
+func (peer *Peer) negotiateCompression(local, remote string) {
+	names := strings.Split(local, "+")
+	for _, name := range strings.Split(remote, "+") {
+		if !slices.Contains(names, name) {
+			continue
+		}
+		peer.rpc.Lock()
+		peer.compressor = peer.rpc.compressor(name)
+		peer.compressMin = peer.rpc.compressMin
+		peer.rpc.Unlock()
+		return
+	}
+}
+
+// writeFrame writes an encoded frame, compressed if it's big
+// enough and compression negotiated.
+func (peer *Peer) writeFrame(frame []byte) error {
+	if peer.compressor != nil && peer.compressMin > 0 && len(frame) >= peer.compressMin {
+		frame = peer.compress(frame)
+	}
+	_, err := peer.conn.Write(frame)
+	return err
+}
+
+// compress wraps a frame in a compressed frame, or returns it as
+// is if compressing doesn't make it smaller.
+func (peer *Peer) compress(frame []byte) []byte {
+	data, err := peer.compressor.Compress(frame)
+	if err != nil {
+		peer.log().Error("unable to compress frame", "err", err)
+		return frame
+	}
+	compressed, err := peer.rpc.codec.Encode(&Message{Type: TypeCompressed, Payload: data})
+	if err != nil || len(compressed) >= len(frame) {
+		return frame
+	}
+	return compressed
+}
+
+// decompress unwraps a compressed frame.
+func (peer *Peer) decompress(frame []byte) ([]byte, error) {
+	if peer.compressor == nil {
+		return nil, errors.New("compression not negotiated")
+	}
+	var msg struct {
+		Payload []byte `json:"payload"`
+	}
+	if err := peer.rpc.codec.Decode(frame, &msg); err != nil {
+		return nil, err
+	}
+	frame, err := peer.compressor.Decompress(msg.Payload)
+	if err == nil && len(frame) > MaxFrameSize {
+		err = ErrFrameTooLarge
+	}
+	return frame, err
+}
@@ -0,0 +1,87 @@
+package duplex
+
+import (
+	"compress/flate"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeNegotiatesCompression(t *testing.T) {
+	conn := NewMockConn()
+	defer conn.Close()
+	rpc := NewTestRPC()
+	rpc.SetCompression(512)
+	conn.inbox <- HandshakeAccept + ";compress=deflate"
+	peer, err := rpc.Handshake(conn)
+	Fatal(err, t)
+	if conn.sent[0].String() != Handshake("json")+";compress=deflate" {
+		t.Fatal("Unexpected handshake frame:", conn.sent[0].String())
+	}
+	if peer.compressor == nil || peer.compressMin != 512 {
+		t.Fatal("Expected compression to be negotiated")
+	}
+}
+
+func TestAcceptPicksCompressor(t *testing.T) {
+	conn := NewMockConn()
+	defer conn.Close()
+	rpc := NewTestRPC()
+	conn.inbox <- Handshake("json") + ";compress=lz4+deflate"
+	peer, err := rpc.Accept(conn)
+	Fatal(err, t)
+	if conn.sent[0].String() != HandshakeAccept+";compress=deflate" {
+		t.Fatal("Unexpected handshake response frame:", conn.sent[0].String())
+	}
+	if peer.compressor != Deflate || peer.compressMin != 0 {
+		t.Fatal("Expected to decompress without compressing")
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetCompression(256, NewDeflateCompressor(flate.BestSpeed))
+	rpc.Register("echo", Echo)
+	_, client, serverConn, clientConn := NewPeerPairConns(rpc)
+
+	large := strings.Repeat("compressible ", 100)
+	var reply string
+	Fatal(client.Call("echo", large, &reply), t)
+	if reply != large {
+		t.Fatal("Unexpected reply:", reply)
+	}
+	Fatal(client.Call("echo", "small", &reply), t)
+	for _, conn := range []*MockConn{clientConn, serverConn} {
+		conn.Lock()
+		call, small := conn.sent[1].String(), conn.sent[2].String()
+		conn.Unlock()
+		if !strings.HasPrefix(call, `{"type":"zip"`) || len(call) > len(large)/2 {
+			t.Fatal("Expected large frame compressed:", call)
+		}
+		if !strings.Contains(small, `"payload":"small"`) {
+			t.Fatal("Expected small frame plain:", small)
+		}
+	}
+}
+
+func TestCompressionWithBatching(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetCompression(256)
+	rpc.SetBatching(10*time.Millisecond, 0)
+	rpc.Register("echo", Echo)
+	_, client := NewPeerPair(rpc)
+	large := strings.Repeat("compressible ", 100)
+	var reply string
+	Fatal(client.Call("echo", large, &reply), t)
+	if reply != large {
+		t.Fatal("Unexpected reply:", reply)
+	}
+}
+
+func TestDeflateLimitsFrameSize(t *testing.T) {
+	data, err := Deflate.Compress(make([]byte, MaxFrameSize+1))
+	Fatal(err, t)
+	if _, err := Deflate.Decompress(data); err != ErrFrameTooLarge {
+		t.Fatal("Expected frame too large, got:", err)
+	}
+}
@@ -1,11 +1,21 @@
 package duplex
 
 import (
+	"crypto/ecdh"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pborman/uuid"
 	"golang.org/x/net/context"
@@ -34,9 +44,38 @@ var (
 	ProtocolVersion = "1.0"
 	TypeRequest     = "req"
 	TypeReply       = "rep"
+	TypeCredit      = "cred"
+	TypeGoAway      = "goaway"
+	TypePing        = "ping"
+	TypePong        = "pong"
+	TypeBatch       = "batch"
+	TypeCompressed  = "zip"
 	HandshakeAccept = "+OK"
 	BacklogSize     = 1024
 	MaxFrameSize    = 1 << 20 // 1mb
+	MaxHandshake    = 1024
+	MaxLogPayload   = 256
+)
+
+// ErrPeerClosed is returned by calls and channels pending or made
+// after the peer's connection is gone. It wraps the read error
+// that ended the connection.
+var ErrPeerClosed = errors.New("duplex: peer closed")
+
+// Optional protocol features negotiated during the handshake.
+const (
+	FeatureFlow     = "flow"
+	FeaturePing     = "ping"
+	FeatureBatch    = "batch"
+	FeatureCompress = "compress"
+	FeatureSeal     = "seal"
+)
+
+const (
+	ErrCodeMethodNotFound = -32601
+	ErrCodeInternal       = -32603
+	ErrCodeBusy           = -32000
+	ErrCodeShuttingDown   = -32001
 )
 
 type Message struct {
@@ -63,6 +102,9 @@ type Codec struct {
 	Name   string
 	Encode func(obj interface{}) ([]byte, error)
 	Decode func(frame []byte, obj interface{}) error
+	// Join wraps encoded messages in a batch message. Codecs
+	// without it don't send batches.
+	Join func(frames [][]byte) ([]byte, error)
 }
 
 func NewJSONCodec() *Codec {
@@ -70,6 +112,7 @@ func NewJSONCodec() *Codec {
 		Name:   "json",
 		Encode: json.Marshal,
 		Decode: json.Unmarshal,
+		Join:   joinJSON,
 	}
 }
 
@@ -77,29 +120,87 @@ type RPC struct {
 	sync.Mutex
 	codec      *Codec
 	registered map[string]func(*Channel) error
+	info       map[string]*MethodInfo
+	identity   interface{}
+	mounts     map[string]*RPC
+	fallback   func(*Channel) error
+	middleware []Middleware
+	logger     *slog.Logger
+	logFrames  bool
+	window     int
+
+	callMiddleware []CallMiddleware
+
+	heartbeat        time.Duration
+	heartbeatTimeout time.Duration
+
+	batchWindow time.Duration
+	batchSize   int
+
+	compressMin int
+	compressors []*Compressor
+
+	sealKey    *ecdh.PrivateKey
+	sealVerify func(*ecdh.PublicKey) error
+
+	handlers     limiter
+	handlerMax   int
+	handlerQueue int
+	peerMax      int
+	peerQueue    int
+	workers      int
+	pool         *pool
 }
 
 func NewRPC(codec *Codec) *RPC {
 	return &RPC{
 		codec:      codec,
 		registered: make(map[string]func(*Channel) error),
+		info:       make(map[string]*MethodInfo),
+		mounts:     make(map[string]*RPC),
 	}
 }
 
-func (rpc *RPC) Register(name string, handler func(*Channel) error) {
+// SetLogger sets the logger used by peers created from this RPC.
+// A nil logger (the default) disables logging.
+func (rpc *RPC) SetLogger(logger *slog.Logger) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.logger = logger
+}
+
+// SetFrameLogging enables logging every frame sent and received
+// at debug level, with payloads truncated to MaxLogPayload.
+func (rpc *RPC) SetFrameLogging(enabled bool) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.logFrames = enabled
+}
+
+// Register adds a method for every peer. Options describe it for
+// introspection.
+func (rpc *RPC) Register(name string, handler func(*Channel) error, opts ...MethodOption) {
 	rpc.Lock()
 	defer rpc.Unlock()
 	rpc.registered[name] = handler
+	rpc.info[name] = methodInfo(name, opts)
 }
 
 func (rpc *RPC) Unregister(name string) {
 	rpc.Lock()
 	defer rpc.Unlock()
 	delete(rpc.registered, name)
+	delete(rpc.info, name)
+}
+
+func (rpc *RPC) RegisterFunc(name string, fn func(interface{}, *Channel) (interface{}, error), opts ...MethodOption) {
+	rpc.Register(name, funcHandler(fn), opts...)
 }
 
-func (rpc *RPC) RegisterFunc(name string, fn func(interface{}, *Channel) (interface{}, error)) {
-	rpc.Register(name, func(ch *Channel) error {
+// funcHandler adapts a function of the request arguments to a
+// handler that replies with its result, or with its error.
+func funcHandler(fn func(interface{}, *Channel) (interface{}, error)) func(*Channel) error {
+	return func(ch *Channel) error {
 		var args interface{}
 		_, err := ch.Recv(&args)
 		if err != nil {
@@ -107,34 +208,145 @@ func (rpc *RPC) RegisterFunc(name string, fn func(interface{}, *Channel) (interf
 		}
 		ret, err := fn(args, ch)
 		if err != nil {
+			if ch.id != 0 {
+				ch.sendError(err)
+			}
 			return err
 		}
 		return ch.Send(ret, false)
-	})
+	}
 }
 
+// CallbackFunc registers fn under a new name on the RPC, callable
+// by every peer and never removed.
+//
+// Deprecated: use Peer.Callback, which is scoped to one peer and
+// removed when it closes.
 func (rpc *RPC) CallbackFunc(fn func(interface{}, *Channel) (interface{}, error)) string {
 	name := "_callback." + uuid.New()
 	rpc.RegisterFunc(name, fn)
 	return name
 }
 
+/*
+Features
+
+Optional protocol extensions are negotiated in the handshake.
+The client lists the features it wants after the codec, and
+the server answers with the subset it accepts:
+
+	SIMPLEX/1.0;json;flow=64
+	+OK;flow=1024
+
+Feature values are the sender's own parameters. Peers that
+list no features see the plain handshake, so implementations
+without extensions are unaffected.
+*/
+
+func (rpc *RPC) offerFeatures() map[string]string {
+	rpc.Lock()
+	defer rpc.Unlock()
+	features := make(map[string]string)
+	if rpc.window > 0 {
+		features[FeatureFlow] = strconv.Itoa(rpc.window)
+	}
+	if rpc.heartbeat > 0 {
+		features[FeaturePing] = ""
+	}
+	if rpc.batchWindow > 0 {
+		features[FeatureBatch] = ""
+	}
+	if rpc.compressMin > 0 {
+		features[FeatureCompress] = rpc.compressorNames()
+	}
+	if offer := rpc.sealOffer(); offer != "" {
+		features[FeatureSeal] = offer
+	}
+	return features
+}
+
+func (rpc *RPC) acceptFeatures(offered map[string]string) map[string]string {
+	rpc.Lock()
+	defer rpc.Unlock()
+	accepted := make(map[string]string)
+	if _, ok := offered[FeatureFlow]; ok {
+		accepted[FeatureFlow] = strconv.Itoa(rpc.receiveWindow())
+	}
+	if _, ok := offered[FeaturePing]; ok {
+		accepted[FeaturePing] = ""
+	}
+	if _, ok := offered[FeatureBatch]; ok {
+		accepted[FeatureBatch] = ""
+	}
+	if name := rpc.pickCompressor(offered[FeatureCompress]); name != "" {
+		accepted[FeatureCompress] = name
+	}
+	if _, ok := offered[FeatureSeal]; ok {
+		if offer := rpc.sealOffer(); offer != "" {
+			accepted[FeatureSeal] = offer
+		}
+	}
+	return accepted
+}
+
+func formatFeatures(prefix string, features map[string]string) string {
+	if len(features) == 0 {
+		return prefix
+	}
+	var list []string
+	for name, value := range features {
+		if value != "" {
+			name = name + "=" + value
+		}
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return prefix + ";" + strings.Join(list, ",")
+}
+
+func parseFeatures(list string) map[string]string {
+	features := make(map[string]string)
+	for _, feature := range strings.Split(list, ",") {
+		if feature == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(feature, "=")
+		features[name] = value
+	}
+	return features
+}
+
 func (rpc *RPC) Handshake(conn io.ReadWriteCloser) (*Peer, error) {
 	peer := NewPeer(rpc, conn, nil)
-	handshake := []byte(fmt.Sprintf("%s/%s;%s",
-		ProtocolName, ProtocolVersion, rpc.codec.Name))
+	offered := rpc.offerFeatures()
+	handshake := []byte(formatFeatures(fmt.Sprintf("%s/%s;%s",
+		ProtocolName, ProtocolVersion, rpc.codec.Name), offered))
 	_, err := conn.Write(handshake)
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, 32)
-	_, err = conn.Read(buf)
+	buf := make([]byte, MaxHandshake)
+	n, err := conn.Read(buf)
 	if err != nil {
 		return nil, err
 	}
 	if buf[0] != '+' {
-		panic(string(buf))
+		panic(string(buf[:n]))
+	}
+	accepted := make(map[string]string)
+	if _, list, ok := strings.Cut(string(buf[:n]), ";"); ok {
+		accepted = parseFeatures(list)
+	}
+	peer.client = true
+	peer.negotiate(offered, accepted)
+	if err := peer.checkSealed(); err != nil {
+		return nil, err
 	}
+	peer.log().Info("handshake",
+		"role", "client",
+		"protocol", ProtocolName+"/"+ProtocolVersion,
+		"codec", rpc.codec.Name,
+		"features", formatFeatures("", accepted))
 	go peer.route()
 	return peer, nil
 }
@@ -145,28 +357,84 @@ func (rpc *RPC) Accept(conn io.ReadWriteCloser) (*Peer, error) {
 
 func (rpc *RPC) AcceptWith(conn io.ReadWriteCloser, ctx context.Context) (*Peer, error) {
 	peer := NewPeer(rpc, conn, ctx)
-	buf := make([]byte, 32)
-	_, err := conn.Read(buf)
+	buf := make([]byte, MaxHandshake)
+	n, err := conn.Read(buf)
 	if err != nil {
 		return nil, err
 	}
 	// TODO: check handshake
-	_, err = conn.Write([]byte(HandshakeAccept))
+	offered := make(map[string]string)
+	if parts := strings.SplitN(string(buf[:n]), ";", 3); len(parts) == 3 {
+		offered = parseFeatures(parts[2])
+	}
+	accepted := rpc.acceptFeatures(offered)
+	_, err = conn.Write([]byte(formatFeatures(HandshakeAccept, accepted)))
 	if err != nil {
 		return nil, err
 	}
+	peer.negotiate(accepted, offered)
+	if err := peer.checkSealed(); err != nil {
+		return nil, err
+	}
+	peer.log().Info("handshake",
+		"role", "server",
+		"handshake", string(buf[:n]))
 	go peer.route()
 	return peer, nil
 }
 
 type Peer struct {
+	// mu guards the channel tables and id counter. reqCh holds
+	// channels for inbound requests, repCh those of outbound
+	// calls still expecting replies.
+	mu      sync.Mutex
 	counter int
 	reqCh   map[int]*Channel
 	repCh   map[int]*Channel
-	rpc     *RPC
-	conn    io.ReadWriteCloser
-	closeCh chan bool
-	ctx     context.Context
+
+	// methods registered on this peer only, guarded by mu
+	registered map[string]func(*Channel) error
+	info       map[string]*MethodInfo
+	callbacks  map[string]*Callback
+
+	callMiddleware []CallMiddleware // guarded by mu
+
+	rpc       *RPC
+	conn      io.ReadWriteCloser
+	closeCh   chan bool
+	closed    chan struct{}
+	closeErr  error // guarded by mu
+	cause     error // guarded by mu
+	ctx       context.Context
+	logger    atomic.Pointer[slog.Logger]
+	logFrames bool
+	window    int
+	sendWin   int
+	handlers  limiter
+	batch     *batcher // nil unless batching
+
+	// compression, nil unless negotiated
+	compressor  *Compressor
+	compressMin int
+
+	client  bool    // made with Handshake
+	sealer  *sealer // nil unless sealing
+	sealErr error   // why sealing wasn't agreed, if it wasn't
+
+	// heartbeat state
+	pings       bool
+	lastSeen    atomic.Int64
+	rtt         atomic.Int64
+	pingNonce   int       // guarded by mu
+	pingSent    time.Time // guarded by mu
+	pingPending bool      // guarded by mu
+	stopPings   chan struct{}
+
+	// shutdown state, guarded by mu
+	active    int
+	draining  bool
+	goingAway bool
+	drained   chan struct{}
 }
 
 func NewPeer(rpc *RPC, conn io.ReadWriteCloser, ctx context.Context) *Peer {
@@ -177,115 +445,545 @@ func NewPeer(rpc *RPC, conn io.ReadWriteCloser, ctx context.Context) *Peer {
 		reqCh:   make(map[int]*Channel),
 		repCh:   make(map[int]*Channel),
 		closeCh: make(chan bool),
+		closed:  make(chan struct{}),
+		drained: make(chan struct{}),
+
+		registered: make(map[string]func(*Channel) error),
+		info:       make(map[string]*MethodInfo),
+		callbacks:  make(map[string]*Callback),
 	}
+	rpc.Lock()
+	logger, logFrames := rpc.logger, rpc.logFrames
+	peer.handlers.set(rpc.peerMax, rpc.peerQueue)
+	peer.callMiddleware = rpc.callMiddleware
+	rpc.Unlock()
+	peer.logFrames = logFrames
+	peer.SetLogger(logger)
 	return peer
 }
 
+// SetLogger overrides the logger inherited from the RPC. Records
+// are tagged with a "peer" attribute identifying the connection.
+func (peer *Peer) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	peer.logger.Store(logger.With("peer", peer.String()))
+}
+
+func (peer *Peer) log() *slog.Logger {
+	return peer.logger.Load()
+}
+
+// String identifies the peer by the remote address of its
+// connection when available.
+func (peer *Peer) String() string {
+	if c, ok := peer.conn.(interface{ RemoteAddr() net.Addr }); ok && c.RemoteAddr() != nil {
+		return c.RemoteAddr().String()
+	}
+	return fmt.Sprintf("%p", peer)
+}
+
+// negotiate applies the features both sides agreed on. local
+// holds this side's parameters and remote those of the other.
+func (peer *Peer) negotiate(local, remote map[string]string) {
+	if _, ok := remote[FeatureFlow]; ok {
+		peer.window, _ = strconv.Atoi(local[FeatureFlow])
+		peer.sendWin, _ = strconv.Atoi(remote[FeatureFlow])
+	}
+	if _, ok := remote[FeaturePing]; ok {
+		peer.pings = true
+		peer.rpc.Lock()
+		interval, timeout := peer.rpc.heartbeat, peer.rpc.heartbeatTimeout
+		peer.rpc.Unlock()
+		peer.SetHeartbeat(interval, timeout)
+	}
+	if _, ok := remote[FeatureBatch]; ok {
+		peer.rpc.Lock()
+		window, size := peer.rpc.batchWindow, peer.rpc.batchSize
+		peer.rpc.Unlock()
+		if join := peer.rpc.codec.Join; window > 0 && join != nil {
+			peer.batch = newBatcher(peer, join, window, size)
+		}
+	}
+	if _, ok := remote[FeatureCompress]; ok {
+		peer.negotiateCompression(local[FeatureCompress], remote[FeatureCompress])
+	}
+	if _, ok := remote[FeatureSeal]; ok {
+		if err := peer.negotiateSeal(local[FeatureSeal], remote[FeatureSeal]); err != nil {
+			peer.log().Error("unable to negotiate sealing", "err", err)
+			peer.sealErr = err
+		}
+	}
+}
+
+// checkSealed fails a handshake that didn't agree on sealing when
+// this side seals.
+func (peer *Peer) checkSealed() error {
+	peer.rpc.Lock()
+	sealing := peer.rpc.sealKey != nil
+	peer.rpc.Unlock()
+	if sealing && peer.sealer == nil {
+		peer.conn.Close()
+		if peer.sealErr != nil {
+			return peer.sealErr
+		}
+		return ErrNotSealed
+	}
+	return nil
+}
+
+// CloseNotify returns a channel that's closed when the peer's
+// connection is gone.
 func (peer *Peer) CloseNotify() <-chan bool {
 	return peer.closeCh
 }
 
+// Done returns a channel that's closed when the peer's connection
+// is gone. Err then reports why.
+func (peer *Peer) Done() <-chan struct{} {
+	return peer.closed
+}
+
+// Err returns nil while the peer is connected, and afterwards an
+// error wrapping ErrPeerClosed and the cause.
+func (peer *Peer) Err() error {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return peer.closeErr
+}
+
+func (peer *Peer) readMsg(frame []byte, msg *Message) error {
+	err := peer.rpc.codec.Decode(frame, msg)
+	if err == nil && peer.logFrames {
+		peer.logFrame("recv", msg, len(frame))
+	}
+	return err
+}
+
+func (peer *Peer) writeMsg(msg *Message) error {
+	if peer.sealer != nil && sealed(msg) {
+		peer.sealer.mu.Lock()
+		defer peer.sealer.mu.Unlock()
+		var err error
+		if msg, err = peer.seal(msg); err != nil {
+			return err
+		}
+	}
+	frame, err := peer.rpc.codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	if peer.logFrames {
+		peer.logFrame("send", msg, len(frame))
+	}
+	if peer.batch != nil {
+		return peer.batch.add(frame)
+	}
+	return peer.writeFrame(frame)
+}
+
+func (peer *Peer) logFrame(dir string, msg *Message, size int) {
+	attrs := []any{
+		"dir", dir,
+		"type", msg.Type,
+		"id", msg.Id,
+		"size", size,
+	}
+	if msg.Method != "" {
+		attrs = append(attrs, "method", msg.Method)
+	}
+	if msg.More {
+		attrs = append(attrs, "more", true)
+	}
+	if msg.Payload != nil {
+		attrs = append(attrs, "payload", sanitize(msg.Payload))
+	}
+	if msg.Error != nil {
+		attrs = append(attrs, "error", sanitize(msg.Error.Message))
+	}
+	peer.log().Debug("frame", attrs...)
+}
+
+// sanitize renders a payload for logging: truncated to MaxLogPayload
+// bytes with non-printable characters escaped.
+func sanitize(v interface{}) string {
+	s := fmt.Sprint(v)
+	if b, ok := v.([]byte); ok {
+		s = string(b)
+	}
+	suffix := ""
+	if len(s) > MaxLogPayload {
+		suffix = fmt.Sprintf("...(%d bytes)", len(s))
+		s = s[:MaxLogPayload]
+	}
+	q := strconv.QuoteToGraphic(s)
+	return q[1:len(q)-1] + suffix
+}
+
 func (peer *Peer) route() {
 	// assumes closing will cause something
 	// here to error and break loop.
 	// TODO: double check
+	var err error
 	for {
+		var n int
 		frame := make([]byte, MaxFrameSize)
-		n, err := peer.conn.Read(frame)
+		n, err = peer.conn.Read(frame)
 		if err != nil {
 			// TODO: what happens on read error
 			break
 		}
+		peer.lastSeen.Store(time.Now().UnixNano())
 		if n == 0 {
 			// ignore empty frames
 			continue
 		}
-		var msg Message
-		err = peer.rpc.codec.Decode(frame[:n], &msg)
+		peer.routeFrame(frame[:n], false)
+	}
+	peer.mu.Lock()
+	if peer.cause != nil {
+		err = peer.cause
+	}
+	peer.mu.Unlock()
+	peer.log().Info("peer closed", "err", err)
+	peer.fail(fmt.Errorf("%w: %w", ErrPeerClosed, err))
+}
+
+// routeFrame routes the message or messages in a frame. A frame
+// that was decompressed can't be compressed again.
+func (peer *Peer) routeFrame(frame []byte, decompressed bool) {
+	var msg Message
+	if err := peer.readMsg(frame, &msg); err != nil {
+		peer.log().Error("protocol error: undecodable frame",
+			"size", len(frame), "err", err)
+		return
+	}
+	switch {
+	case msg.Type == TypeCompressed && !decompressed:
+		inner, err := peer.decompress(frame)
 		if err != nil {
-			// TODO: what happens on decode error
-			panic(err)
+			peer.log().Error("protocol error: undecompressable frame",
+				"size", len(frame), "err", err)
+			return
 		}
-		switch msg.Type {
-		case TypeRequest:
-			ch, exists := peer.reqCh[msg.Id]
-			if exists {
-				if !msg.More {
-					delete(peer.reqCh, msg.Id)
-				}
-			} else {
-				ch = NewChannel(peer, TypeReply, msg.Method)
-				if msg.Id != 0 {
-					ch.id = msg.Id
-					if msg.More {
-						peer.reqCh[ch.id] = ch
-					}
-				}
-				peer.rpc.Lock()
-				fn, exists := peer.rpc.registered[msg.Method]
-				peer.rpc.Unlock()
-				if exists {
-					go fn(ch)
-				} else {
-					// TODO: method missing
-					panic(msg.Method)
-				}
-			}
-			if msg.Ext != nil {
-				ch.ext = msg.Ext
-			}
-			ch.inbox <- &msg
-			if !msg.More {
-				close(ch.inbox)
-			}
+		peer.routeFrame(inner, true)
+	case msg.Type == TypeBatch:
+		peer.unbatch(frame)
+	default:
+		peer.routeMsg(&msg)
+	}
+}
 
-		case TypeReply:
-			if msg.Error != nil {
-				// TODO: better handling of missing id
-				ch := peer.repCh[msg.Id]
-				ch.err = msg.Error
-				ch.done <- ch
-				close(ch.inbox)
-				delete(peer.repCh, msg.Id)
-			} else {
-				// TODO: better handling of missing id
-				ch := peer.repCh[msg.Id]
-				ch.inbox <- &msg
-				if !msg.More {
-					ch.done <- ch
-					close(ch.inbox)
-					delete(peer.repCh, msg.Id)
-				}
-			}
-		default:
-			panic("bad msg type: " + msg.Type)
+func (peer *Peer) routeMsg(msg *Message) {
+	if peer.sealer != nil && sealed(msg) {
+		if err := peer.unseal(msg); err != nil {
+			peer.log().Error("protocol error: unable to unseal message",
+				"type", msg.Type, "id", msg.Id, "err", err)
+			peer.closeWith(ErrSealBroken)
+			return
+		}
+	}
+	switch msg.Type {
+	case TypeRequest:
+		peer.routeRequest(msg)
+	case TypeReply:
+		peer.routeReply(msg)
+	case TypeCredit:
+		peer.credit(msg)
+	case TypeGoAway:
+		peer.goAway()
+	case TypePing:
+		peer.pong(msg)
+	case TypePong:
+		peer.measure(msg)
+	default:
+		peer.log().Error("protocol error: bad message type",
+			"type", msg.Type, "id", msg.Id)
+	}
+}
+
+// fail records why the peer closed and fails every channel still
+// waiting on the remote.
+func (peer *Peer) fail(err error) {
+	peer.mu.Lock()
+	peer.closeErr = err
+	var pending []*Channel
+	for id, ch := range peer.repCh {
+		pending = append(pending, ch)
+		delete(peer.repCh, id)
+	}
+	for _, ch := range peer.reqCh {
+		pending = append(pending, ch)
+	}
+	for _, cb := range peer.callbacks {
+		peer.dropCallback(cb)
+	}
+	peer.checkDrained()
+	peer.mu.Unlock()
+	for _, ch := range pending {
+		ch.mu.Lock()
+		ended := ch.recvClosed
+		if !ended {
+			ch.err = err
+		}
+		ch.mu.Unlock()
+		ch.closeInbox()
+		// a call whose replies ended was signalled done then
+		if ch.typ == TypeRequest && !ended {
+			ch.done <- ch
+		}
+	}
+	close(peer.closed)
+	close(peer.closeCh)
+}
+
+func (peer *Peer) routeRequest(msg *Message) {
+	peer.mu.Lock()
+	ch, exists := peer.reqCh[msg.Id]
+	peer.mu.Unlock()
+	if !exists {
+		if ch = peer.start(msg); ch == nil {
+			return
 		}
 	}
-	peer.closeCh <- true
+	if msg.Ext != nil {
+		ch.SetExt(msg.Ext)
+	}
+	peer.deliver(ch, msg)
+}
+
+// start dispatches the handler for a new inbound request, or
+// answers with an error and returns nil if it can't be served.
+func (peer *Peer) start(msg *Message) *Channel {
+	ch := NewChannel(peer, TypeReply, msg.Method)
+	ch.id = msg.Id
+	fn := peer.lookup(msg.Method)
+	if fn == nil {
+		peer.log().Warn("unknown method",
+			"method", msg.Method, "id", msg.Id)
+		if ch.id != 0 {
+			ch.SendErr(ErrCodeMethodNotFound, "method not found: "+msg.Method, nil)
+		}
+		return nil
+	}
+	peer.mu.Lock()
+	draining := peer.draining
+	if !draining {
+		if ch.id != 0 {
+			peer.reqCh[ch.id] = ch
+		}
+		peer.active++
+	}
+	peer.mu.Unlock()
+	if draining {
+		peer.log().Info("refused request while shutting down",
+			"method", msg.Method, "id", msg.Id)
+		if ch.id != 0 {
+			ch.SendErr(ErrCodeShuttingDown, "shutting down", nil)
+		}
+		return nil
+	}
+	peer.dispatch(fn, ch)
+	return ch
+}
+
+// lookup finds the handler for method, preferring the built-in
+// methods, then callbacks and methods registered on the peer, to
+// those its RPC resolves. The RPC's middleware applies to all.
+func (peer *Peer) lookup(method string) func(*Channel) error {
+	if fn := peer.builtin(method); fn != nil {
+		return peer.rpc.wrap(method, fn)
+	}
+	peer.mu.Lock()
+	fn := peer.callback(method)
+	if fn == nil {
+		fn = peer.registered[method]
+	}
+	peer.mu.Unlock()
+	if fn != nil {
+		return peer.rpc.wrap(method, fn)
+	}
+	return peer.rpc.handler(method)
+}
+
+func (peer *Peer) routeReply(msg *Message) {
+	peer.mu.Lock()
+	ch, exists := peer.repCh[msg.Id]
+	peer.mu.Unlock()
+	if !exists {
+		peer.log().Error("protocol error: reply for unknown id",
+			"id", msg.Id)
+		return
+	}
+	ch.mu.Lock()
+	ended := ch.recvClosed
+	ch.mu.Unlock()
+	if ended {
+		peer.log().Error("protocol error: message after end of stream",
+			"method", ch.method, "id", ch.id)
+		return
+	}
+	if msg.Error != nil {
+		ch.err = msg.Error
+		ch.closeInbox()
+		// the call failed, so the rest of its request stream is moot
+		ch.stop()
+	} else {
+		peer.deliver(ch, msg)
+	}
+	if msg.Error != nil || !msg.More {
+		peer.releaseOutbound(ch, msg.Error != nil)
+		ch.done <- ch
+	}
+}
+
+// handle runs a handler for an inbound request. The channel stays
+// routable until both the handler returns and the request stream
+// ends, so late stream messages aren't mistaken for new requests.
+func (peer *Peer) handle(fn func(*Channel) error, ch *Channel) {
+	if err := fn(ch); err != nil {
+		peer.log().Error("handler error",
+			"method", ch.method, "id", ch.id, "err", err)
+	}
+	ch.mu.Lock()
+	ch.handled = true
+	ch.mu.Unlock()
+	ch.stopReading()
+	peer.release(ch)
+	peer.handlerDone()
+}
+
+func (peer *Peer) handlerDone() {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.active--
+	peer.checkDrained()
+}
+
+// release drops an inbound channel from the request table once
+// its handler has returned and its request stream has ended.
+func (peer *Peer) release(ch *Channel) {
+	ch.mu.Lock()
+	finished := ch.handled && ch.recvClosed
+	ch.mu.Unlock()
+	if finished {
+		peer.untrack(peer.reqCh, ch)
+	}
+}
+
+// releaseOutbound drops an outbound channel from the reply table
+// once its replies and its request stream have both ended, so
+// credit for the request stream reaches it after the replies end.
+// A failed call is dropped as soon as its error arrives.
+func (peer *Peer) releaseOutbound(ch *Channel, failed bool) {
+	ch.mu.Lock()
+	finished := failed || ch.sendClosed && ch.recvClosed
+	ch.mu.Unlock()
+	if finished {
+		peer.untrack(peer.repCh, ch)
+		ch.revokeCallbacks()
+	}
+}
+
+func (peer *Peer) untrack(table map[int]*Channel, ch *Channel) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if table[ch.id] == ch {
+		delete(table, ch.id)
+		peer.checkDrained()
+	}
 }
 
 func (peer *Peer) Close() error {
+	if peer.batch != nil {
+		peer.batch.drain()
+	}
 	return peer.conn.Close()
 }
 
+// closeWith closes the connection, reporting cause rather than
+// the resulting read error as the reason.
+func (peer *Peer) closeWith(cause error) error {
+	peer.mu.Lock()
+	if peer.cause == nil {
+		peer.cause = cause
+	}
+	peer.mu.Unlock()
+	return peer.Close()
+}
+
+// Register adds a method callable only by this peer's remote. It
+// takes precedence over a method of the same name on the RPC.
+func (peer *Peer) Register(name string, handler func(*Channel) error, opts ...MethodOption) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.registered[name] = handler
+	peer.info[name] = methodInfo(name, opts)
+}
+
+// Unregister removes a method added with Register, uncovering any
+// method of the same name on the RPC.
+func (peer *Peer) Unregister(name string) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	delete(peer.registered, name)
+	delete(peer.info, name)
+}
+
+// Call invokes method with args and waits for its result in reply.
+// With a nil reply the call is sent as a notification, without an
+// id, and Call returns as soon as it's sent. The handler still
+// runs, but anything it replies is dropped.
 func (peer *Peer) Call(method string, args interface{}, reply interface{}) error {
+	return peer.CallContext(context.Background(), method, args, reply)
+}
+
+// CallContext is like Call but stops waiting for the reply once
+// ctx is done, returning its error. A reply arriving later is
+// dropped.
+func (peer *Peer) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	return peer.invoker()(ctx, method, args, reply)
+}
+
+// call makes a call without any call middleware.
+func (peer *Peer) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	if reply == nil {
+		return NewChannel(peer, TypeRequest, method).Send(args, false)
+	}
 	ch := peer.Open(method)
 	err := ch.Send(args, false)
 	if err != nil {
 		return err
 	}
-	if reply != nil {
-		_, err = ch.Recv(reply)
-		if err != nil {
-			return err
+	msg, err := ch.recvMsgContext(ctx)
+	if msg == nil {
+		if ctx.Err() != nil {
+			ch.abandon()
 		}
-		return (<-ch.done).err
+		return err
+	}
+	if err := ch.decode(msg.Payload, reply); err != nil {
+		return err
+	}
+	select {
+	case <-ch.done:
+		return ch.err
+	case <-ctx.Done():
+		ch.abandon()
+		return ctx.Err()
 	}
-	return nil
 }
 
 func (peer *Peer) Open(service string) *Channel {
 	ch := NewChannel(peer, TypeRequest, service)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.closeErr != nil {
+		ch.err = peer.closeErr
+		ch.closeInbox()
+		return ch
+	}
 	peer.counter = peer.counter + 1
 	ch.id = peer.counter
 	peer.repCh[ch.id] = ch
@@ -302,91 +1000,296 @@ type Channel struct {
 	method string
 	id     int
 	err    error
+
+	readBuf []byte
+
+	mu          sync.Mutex
+	opened      bool
+	sendClosed  bool
+	recvClosed  bool
+	stopped     bool
+	callbacks   []*Callback // made from funcs sent with the call
+	handled     bool
+	abandoned   bool
+	credits     int
+	consumed    int
+	creditCh    chan struct{}
+	sendTimeout time.Duration
 }
 
 func NewChannel(peer *Peer, typ string, method string) *Channel {
+	backlog := BacklogSize
+	if peer.flow() {
+		// the final message of a stream never waits for credit
+		backlog = peer.window + 1
+	}
 	return &Channel{
-		Peer:   peer,
-		inbox:  make(chan *Message, BacklogSize),
-		done:   make(chan *Channel, 1), // buffered
-		ext:    nil,
-		typ:    typ,
-		method: method,
-		id:     0,
-		err:    nil,
+		Peer:     peer,
+		inbox:    make(chan *Message, backlog),
+		done:     make(chan *Channel, 1), // buffered
+		ext:      nil,
+		typ:      typ,
+		method:   method,
+		id:       0,
+		err:      nil,
+		credits:  peer.sendWin,
+		creditCh: make(chan struct{}, 1),
 	}
 }
 
 func (ch *Channel) SetExt(ext interface{}) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
 	ch.ext = ext
 }
 
+func (ch *Channel) getExt() interface{} {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.ext
+}
+
 func (ch *Channel) SendErr(code int, message string, data interface{}) error {
 	return ch.sendMsg(&Message{
 		Type:   ch.typ,
 		Method: ch.method,
 		More:   false,
 		Id:     ch.id,
-		Ext:    ch.ext,
+		Ext:    ch.getExt(),
 		Error:  &Error{code, message, data},
 	})
 }
 
+// sendError replies with err, keeping its code if it's an *Error.
+func (ch *Channel) sendError(err error) error {
+	var rpcError *Error
+	if errors.As(err, &rpcError) {
+		return ch.SendErr(rpcError.Code, rpcError.Message, rpcError.Data)
+	}
+	return ch.SendErr(ErrCodeInternal, err.Error(), nil)
+}
+
 // not convenient enough? we'll see
 func (ch *Channel) SendLast(obj interface{}) error {
 	return ch.Send(obj, false)
 }
 
 func (ch *Channel) Send(obj interface{}, more bool) error {
+	if ch.notified() {
+		return nil
+	}
+	obj, err := ch.marshalFuncs(obj)
+	if err != nil {
+		return err
+	}
+	if more {
+		if err := ch.acquireCredit(); err != nil {
+			return err
+		}
+	}
 	return ch.sendMsg(&Message{
 		Type:    ch.typ,
 		Method:  ch.method,
 		Payload: obj,
 		More:    more,
 		Id:      ch.id,
-		Ext:     ch.ext,
+		Ext:     ch.getExt(),
 	})
 }
 
+// notified reports whether the channel answers a notification,
+// whose replies would have no call to go to and are dropped.
+func (ch *Channel) notified() bool {
+	return ch.typ == TypeReply && ch.id == 0
+}
+
 func (ch *Channel) sendMsg(msg *Message) error {
-	frame, err := ch.rpc.codec.Encode(msg)
-	if err != nil {
-		return err
+	if ch.notified() {
+		return nil
 	}
-	_, err = ch.conn.Write(frame)
-	if ch.id == 0 {
-		ch.done <- ch
-		close(ch.inbox) // is this bad?
+	if ch.typ == TypeRequest {
+		if err := ch.opening(); err != nil {
+			return err
+		}
+	}
+	err := ch.writeMsg(msg)
+	if !msg.More {
+		ch.mu.Lock()
+		ch.sendClosed = true
+		ch.mu.Unlock()
+		if ch.id != 0 && ch.typ == TypeRequest {
+			ch.releaseOutbound(ch, false)
+		}
+	}
+	if ch.id == 0 && ch.typ == TypeRequest {
+		// nothing will be routed to an outbound channel without an id
+		select {
+		case ch.done <- ch:
+		default:
+		}
+		ch.closeInbox()
 	}
 	return err
 }
 
+// deliver queues a routed message on the channel, closing the
+// inbox after the last one. Messages for a handler that already
+// returned, or a stream that was abandoned, are dropped. Only the route loop delivers, so only it
+// closes the inbox of a routed channel.
+func (peer *Peer) deliver(ch *Channel, msg *Message) {
+	ch.mu.Lock()
+	ended, dropped := ch.recvClosed, ch.handled || ch.abandoned
+	if !msg.More {
+		ch.recvClosed = true
+	}
+	ch.mu.Unlock()
+	if ended {
+		peer.log().Error("protocol error: message after end of stream",
+			"method", ch.method, "id", ch.id)
+		return
+	}
+	if !dropped {
+		peer.enqueue(ch, msg)
+	}
+	if !msg.More {
+		close(ch.inbox)
+		if ch.typ == TypeReply {
+			peer.release(ch)
+		}
+	}
+}
+
+// abandon drops the rest of the stream the channel receives, such
+// as an outbound call's replies.
+func (ch *Channel) abandon() {
+	ch.mu.Lock()
+	ch.abandoned = true
+	ch.mu.Unlock()
+	ch.stopReading()
+}
+
+func (ch *Channel) closeInbox() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if !ch.recvClosed {
+		ch.recvClosed = true
+		close(ch.inbox)
+	}
+}
+
 func (ch *Channel) Recv(obj interface{}) (bool, error) {
+	msg, err := ch.recvMsg()
+	if msg == nil {
+		return false, err
+	}
+	return msg.More, ch.decode(msg.Payload, obj)
+}
+
+// decode stores a payload in obj, converting it through the codec
+// when its decoded form can't be assigned directly.
+func (ch *Channel) decode(payload, obj interface{}) error {
+	value := reflect.ValueOf(payload)
+	if !value.IsValid() {
+		return nil
+	}
+	dst := reflect.ValueOf(obj).Elem()
+	if value.Type().AssignableTo(dst.Type()) {
+		dst.Set(value)
+		return nil
+	}
+	frame, err := ch.rpc.codec.Encode(payload)
+	if err != nil {
+		return err
+	}
+	return ch.rpc.codec.Decode(frame, obj)
+}
+
+// recvMsg returns the next message, or nil and the channel's
+// error once the inbox is closed.
+func (ch *Channel) recvMsg() (*Message, error) {
+	return ch.recvMsgContext(context.Background())
+}
+
+// recvMsgContext is like recvMsg but returns ctx's error if it's
+// done first.
+func (ch *Channel) recvMsgContext(ctx context.Context) (*Message, error) {
+	var msg *Message
+	var ok bool
 	select {
-	case msg, ok := <-ch.inbox:
-		if !ok {
-			return false, ch.err
-		}
-		payload := reflect.ValueOf(msg.Payload)
-		if payload.IsValid() {
-			reflect.ValueOf(obj).Elem().Set(payload)
-		}
-		return msg.More, nil
+	case msg, ok = <-ch.inbox:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+	if !ok {
+		return nil, ch.err
+	}
+	if msg.More {
+		ch.releaseCredit()
+	}
+	msg.Payload = ch.unmarshalFuncs(msg.Payload)
+	return msg, nil
 }
 
 func (ch *Channel) Context() context.Context {
 	return ch.Peer.ctx
 }
 
-/*
-// convenience method to read []byte object
-func (ch *Channel) Read(p []byte) (n int, err error) {
+var _ io.ReadWriteCloser = (*Channel)(nil)
 
+// Read reads bytes from a stream of []byte payloads as sent by
+// Write, returning io.EOF once the remote closes the stream.
+func (ch *Channel) Read(p []byte) (n int, err error) {
+	for len(ch.readBuf) == 0 {
+		msg, err := ch.recvMsg()
+		if msg == nil {
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		if ch.readBuf, err = payloadBytes(msg.Payload); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, ch.readBuf)
+	ch.readBuf = ch.readBuf[n:]
+	return n, nil
 }
 
-// convenience method to write []byte object
+// Write sends p as a []byte payload in the middle of a stream.
 func (ch *Channel) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := ch.Send(p, true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the stream written by Write, which the remote reads
+// as io.EOF, if it hasn't ended. Unlike Peer.Close it leaves the
+// connection open.
+func (ch *Channel) Close() error {
+	ch.mu.Lock()
+	ended := ch.sendClosed
+	ch.mu.Unlock()
+	if ended {
+		return nil
+	}
+	return ch.Send(nil, false)
+}
 
+// payloadBytes returns the bytes of a []byte payload. Codecs
+// without a binary type, like JSON, carry them base64 encoded.
+func payloadBytes(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return p, nil
+	case string:
+		return base64.StdEncoding.DecodeString(p)
+	}
+	return nil, fmt.Errorf("duplex: unexpected %T payload in byte stream", payload)
 }
-*/
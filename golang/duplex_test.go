@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"strings"
 	"sync"
@@ -21,6 +24,7 @@ type MockConn struct {
 	sync.Mutex
 
 	sent           []*bytes.Buffer
+	inboxMu        sync.Mutex
 	closed         bool
 	inbox          chan string
 	paired         *MockConn
@@ -48,8 +52,12 @@ func (conn *MockConn) ExpectWrites(n int) {
 }
 
 func (conn *MockConn) Close() error {
-	conn.closed = true
-	close(conn.inbox)
+	conn.inboxMu.Lock()
+	defer conn.inboxMu.Unlock()
+	if !conn.closed {
+		conn.closed = true
+		close(conn.inbox)
+	}
 	return nil
 }
 
@@ -59,10 +67,7 @@ func (conn *MockConn) Write(p []byte) (int, error) {
 	buf := bytes.NewBuffer(p)
 	conn.sent = append(conn.sent, buf)
 	if conn.paired != nil {
-		conn.paired.inbox <- buf.String()
-	}
-	if os.Getenv("DEBUG") != "" {
-		fmt.Println(buf.String())
+		conn.paired.deliver(buf.String())
 	}
 	if conn.expectedWrites > 0 {
 		conn.writes.Done()
@@ -70,6 +75,14 @@ func (conn *MockConn) Write(p []byte) (int, error) {
 	return buf.Len(), nil
 }
 
+func (conn *MockConn) deliver(frame string) {
+	conn.inboxMu.Lock()
+	defer conn.inboxMu.Unlock()
+	if !conn.closed {
+		conn.inbox <- frame
+	}
+}
+
 func (conn *MockConn) Read(p []byte) (int, error) {
 	if conn.expectedReads > 0 {
 		defer conn.reads.Done()
@@ -78,10 +91,19 @@ func (conn *MockConn) Read(p []byte) (int, error) {
 	if !ok {
 		return 0, fmt.Errorf("Inbox closed")
 	}
+	return copy(p, v), nil
+}
+
+// NewTestRPC returns a JSON RPC that logs frames to stderr
+// when the DEBUG environment variable is set.
+func NewTestRPC() *RPC {
+	rpc := NewRPC(NewJSONCodec())
 	if os.Getenv("DEBUG") != "" {
-		defer fmt.Println(v)
+		rpc.SetLogger(slog.New(slog.NewTextHandler(os.Stderr,
+			&slog.HandlerOptions{Level: slog.LevelDebug})))
+		rpc.SetFrameLogging(true)
 	}
-	return copy(p, v), nil
+	return rpc
 }
 
 func NewConnPair() (*MockConn, *MockConn) {
@@ -93,6 +115,13 @@ func NewConnPair() (*MockConn, *MockConn) {
 }
 
 func NewPeerPair(rpc *RPC) (*Peer, *Peer) {
+	peer1, peer2, _, _ := NewPeerPairConns(rpc)
+	return peer1, peer2
+}
+
+// NewPeerPairConns is like NewPeerPair but also returns the conns
+// of the peers, to see the frames they write.
+func NewPeerPairConns(rpc *RPC) (*Peer, *Peer, *MockConn, *MockConn) {
 	conn1, conn2 := NewConnPair()
 	var wg sync.WaitGroup
 	var peer1, peer2 *Peer
@@ -106,7 +135,7 @@ func NewPeerPair(rpc *RPC) (*Peer, *Peer) {
 		wg.Done()
 	}()
 	wg.Wait()
-	return peer1, peer2
+	return peer1, peer2, conn1, conn2
 }
 
 func Echo(ch *Channel) error {
@@ -186,7 +215,7 @@ func Fatal(err error, t *testing.T) {
 func TestHandshake(t *testing.T) {
 	conn := NewMockConn()
 	defer conn.Close()
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	conn.inbox <- HandshakeAccept
 	rpc.Handshake(conn)
 	if conn.sent[0].String() != Handshake("json") {
@@ -197,7 +226,7 @@ func TestHandshake(t *testing.T) {
 func TestAccept(t *testing.T) {
 	conn := NewMockConn()
 	defer conn.Close()
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	conn.inbox <- Handshake("json")
 	rpc.Accept(conn)
 	if conn.sent[0].String() != HandshakeAccept {
@@ -209,7 +238,7 @@ func TestRegisteredFuncAfterAccept(t *testing.T) {
 	conn := NewMockConn()
 	defer conn.Close()
 	conn.ExpectWrites(2)
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	rpc.Register("echo", Echo)
 	conn.inbox <- Handshake("json")
 	rpc.Accept(conn)
@@ -232,7 +261,7 @@ func TestRegisteredFuncAfterHandshake(t *testing.T) {
 	conn := NewMockConn()
 	defer conn.Close()
 	conn.ExpectWrites(2)
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	rpc.Register("echo", Echo)
 	conn.inbox <- HandshakeAccept
 	rpc.Handshake(conn)
@@ -255,7 +284,7 @@ func TestCallAfterHandshake(t *testing.T) {
 	conn := NewMockConn()
 	defer conn.Close()
 	conn.ExpectWrites(2)
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	conn.inbox <- HandshakeAccept
 	peer, err := rpc.Handshake(conn)
 	Fatal(err, t)
@@ -283,7 +312,7 @@ func TestCallAfterAccept(t *testing.T) {
 	conn := NewMockConn()
 	defer conn.Close()
 	conn.ExpectWrites(2)
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	conn.inbox <- Handshake("json")
 	peer, err := rpc.Accept(conn)
 	Fatal(err, t)
@@ -311,7 +340,7 @@ func TestAllOnPairedPeers(t *testing.T) {
 	conn1, conn2 := NewConnPair()
 	defer conn1.Close()
 	defer conn2.Close()
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	rpc.Register("echo-tag", func(ch *Channel) error {
 		var obj map[string]interface{}
 		if _, err := ch.Recv(&obj); err != nil {
@@ -325,40 +354,46 @@ func TestAllOnPairedPeers(t *testing.T) {
 	var err1, err2 error
 	wg.Add(2)
 	go func() {
+		defer wg.Done()
 		peer1, err1 = rpc.Accept(conn1)
-		Fatal(err1, t)
-		wg.Done()
 	}()
 	go func() {
+		defer wg.Done()
 		peer2, err2 = rpc.Handshake(conn2)
-		Fatal(err2, t)
-		wg.Done()
 	}()
 	wg.Wait()
+	Fatal(err1, t)
+	Fatal(err2, t)
 	wg.Add(2)
 	go func() {
+		defer wg.Done()
 		var reply map[string]interface{}
 		err := peer1.Call("echo-tag", map[string]string{"from": "peer1"}, &reply)
-		Fatal(err, t)
+		if err != nil {
+			t.Error(err)
+			return
+		}
 		if reply["from"] != "peer1" || reply["tag"] != true {
-			t.Fatal("Unexpected reply to peer1:", reply)
+			t.Error("Unexpected reply to peer1:", reply)
 		}
-		wg.Done()
 	}()
 	go func() {
+		defer wg.Done()
 		var reply map[string]interface{}
 		err := peer2.Call("echo-tag", map[string]string{"from": "peer2"}, &reply)
-		Fatal(err, t)
+		if err != nil {
+			t.Error(err)
+			return
+		}
 		if reply["from"] != "peer2" || reply["tag"] != true {
-			t.Fatal("Unexpected reply to peer2:", reply)
+			t.Error("Unexpected reply to peer2:", reply)
 		}
-		wg.Done()
 	}()
 	wg.Wait()
 }
 
 func TestStreamingMultipleResults(t *testing.T) {
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	rpc.Register("count", Generator)
 	client, _ := NewPeerPair(rpc)
 	ch := client.Open("count")
@@ -383,7 +418,7 @@ func TestStreamingMultipleResults(t *testing.T) {
 }
 
 func TestStreamingMultipleArguments(t *testing.T) {
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	rpc.Register("adder", Adder)
 	client, _ := NewPeerPair(rpc)
 	ch := client.Open("adder")
@@ -432,7 +467,7 @@ func TestCustomCodec(t *testing.T) {
 }
 
 func TestHiddenExt_EXPERIMENTAL(t *testing.T) {
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	rpc.Register("echo", Echo)
 	client, server := NewPeerPair(rpc)
 	ch := client.Open("echo")
@@ -454,7 +489,7 @@ func TestHiddenExt_EXPERIMENTAL(t *testing.T) {
 }
 
 func TestRegisterFuncAndCallbackFunc(t *testing.T) {
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	rpc.RegisterFunc("callback", func(arg interface{}, ch *Channel) (interface{}, error) {
 		args := arg.([]interface{})
 		var ret interface{}
@@ -476,8 +511,41 @@ func TestRegisterFuncAndCallbackFunc(t *testing.T) {
 	}
 }
 
+func TestPeerRegister(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("whoami", func(ch *Channel) error {
+		return ch.Send("rpc", false)
+	})
+	server, client := NewPeerPair(rpc)
+	other, otherClient := NewPeerPair(rpc)
+	server.Register("whoami", func(ch *Channel) error {
+		return ch.Send("peer", false)
+	})
+	server.Register("session", Echo)
+	var reply string
+	Fatal(client.Call("whoami", nil, &reply), t)
+	if reply != "peer" {
+		t.Fatal("Peer method didn't take precedence:", reply)
+	}
+	Fatal(client.Call("session", "hello", &reply), t)
+	Fatal(otherClient.Call("whoami", nil, &reply), t)
+	if reply != "rpc" {
+		t.Fatal("Peer method visible to another peer:", reply)
+	}
+	err := otherClient.Call("session", "hello", &reply)
+	if rpcError, ok := err.(*Error); !ok || rpcError.Code != ErrCodeMethodNotFound {
+		t.Fatal("Expected method not found, got:", err)
+	}
+	server.Unregister("whoami")
+	Fatal(client.Call("whoami", nil, &reply), t)
+	if reply != "rpc" {
+		t.Fatal("Unregister didn't restore RPC method:", reply)
+	}
+	other.Close()
+}
+
 func TestCallAsyncWhenReplyNil(t *testing.T) {
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	received := make(chan bool, 1)
 	sent := make(chan bool, 1)
 	rpc.Register("noreply", func(ch *Channel) error {
@@ -503,8 +571,35 @@ func TestCallAsyncWhenReplyNil(t *testing.T) {
 	}
 }
 
-func TestErrorReplyCall(t *testing.T) {
+func TestCallWithoutReplyDropsFuncResult(t *testing.T) {
+	var logs logBuffer
 	rpc := NewRPC(NewJSONCodec())
+	rpc.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	called := make(chan bool, 1)
+	rpc.RegisterFunc("double", func(arg interface{}, ch *Channel) (interface{}, error) {
+		called <- true
+		return arg.(float64) * 2, nil
+	})
+	rpc.Register("echo", Echo)
+	server, client := NewPeerPair(rpc)
+	Fatal(client.Call("double", 2, nil), t)
+	<-called
+	waitFor(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.active == 0
+	})
+	// frames arrive in order, so once echo answers any reply to
+	// double has been routed
+	var reply string
+	Fatal(client.Call("echo", "after", &reply), t)
+	if line := logLine(logs.String(), `"protocol error: reply for unknown id"`); line != "" {
+		t.Fatal("Unexpected reply to notification:", line)
+	}
+}
+
+func TestErrorReplyCall(t *testing.T) {
+	rpc := NewTestRPC()
 	rpc.Register("errorReply", ReturnError)
 	client, _ := NewPeerPair(rpc)
 	var reply interface{}
@@ -526,7 +621,7 @@ func TestErrorReplyCall(t *testing.T) {
 }
 
 func TestErrorInStream(t *testing.T) {
-	rpc := NewRPC(NewJSONCodec())
+	rpc := NewTestRPC()
 	rpc.Register("errorInStream", GeneratorThatErrorsAfterSecond)
 	client, _ := NewPeerPair(rpc)
 	ch := client.Open("errorInStream")
@@ -563,3 +658,258 @@ func TestErrorInStream(t *testing.T) {
 		t.Fatal("Unexpected final count:", count)
 	}
 }
+
+type logBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func logLine(logs, msg string) string {
+	for _, line := range strings.Split(logs, "\n") {
+		if strings.Contains(line, "msg="+msg+" ") {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestLoggingUnknownMethodAndHandlerError(t *testing.T) {
+	var logs logBuffer
+	rpc := NewRPC(NewJSONCodec())
+	rpc.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	rpc.Register("fails", func(ch *Channel) error {
+		var obj interface{}
+		ch.Recv(&obj)
+		ch.SendErr(TestErrorCode, TestErrorMessage, nil)
+		return fmt.Errorf("handler failed")
+	})
+	client, _ := NewPeerPair(rpc)
+	err := client.Call("missing", nil, new(interface{}))
+	rpcError, ok := err.(*Error)
+	if !ok || rpcError.Code != ErrCodeMethodNotFound {
+		t.Fatal("Unexpected error:", err)
+	}
+	client.Call("fails", nil, new(interface{}))
+	waitFor(t, func() bool {
+		return logLine(logs.String(), `"handler error"`) != ""
+	})
+	out := logs.String()
+	for msg, expected := range map[string]string{
+		"handshake":        "role=",
+		`"unknown method"`: "method=missing id=1",
+		`"handler error"`:  `method=fails id=2 err="handler failed"`,
+	} {
+		line := logLine(out, msg)
+		if !strings.Contains(line, "peer=") || !strings.Contains(line, expected) {
+			t.Fatalf("Expected %s record with %q in logs:\n%s", msg, expected, out)
+		}
+	}
+}
+
+func TestFrameLoggingSanitizesPayload(t *testing.T) {
+	var logs logBuffer
+	rpc := NewRPC(NewJSONCodec())
+	rpc.SetLogger(slog.New(slog.NewTextHandler(&logs,
+		&slog.HandlerOptions{Level: slog.LevelDebug})))
+	rpc.SetFrameLogging(true)
+	rpc.Register("echo", Echo)
+	client, _ := NewPeerPair(rpc)
+	var reply string
+	err := client.Call("echo", "bell\a"+strings.Repeat("x", MaxLogPayload), &reply)
+	Fatal(err, t)
+	out := logs.String()
+	if !strings.Contains(logLine(out, "frame"), "dir=send type=req id=1") {
+		t.Fatal("Expected sent frame in logs:", out)
+	}
+	if !strings.Contains(out, `bell\\a`) || !strings.Contains(out, "...(261 bytes)") {
+		t.Fatal("Expected sanitized payload in logs:", out)
+	}
+}
+
+func TestConcurrentStreamsStress(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("count", Generator)
+	rpc.Register("adder", Adder)
+	peer1, peer2 := NewPeerPair(rpc)
+	var wg sync.WaitGroup
+	errs := make(chan error, 400)
+	for i := 0; i < 400; i++ {
+		peer := peer1
+		if i%2 == 1 {
+			peer = peer2
+		}
+		wg.Add(1)
+		go func(i int, peer *Peer) {
+			defer wg.Done()
+			if i%4 < 2 {
+				ch := peer.Open("count")
+				if err := ch.Send(10, false); err != nil {
+					errs <- err
+					return
+				}
+				var reply map[string]interface{}
+				count := 0.0
+				for more := true; more; {
+					var err error
+					if more, err = ch.Recv(&reply); err != nil {
+						errs <- err
+						return
+					}
+					count += reply["num"].(float64)
+				}
+				if count != 55 {
+					errs <- fmt.Errorf("unexpected count: %v", count)
+				}
+				return
+			}
+			ch := peer.Open("adder")
+			for n := 1; n <= 10; n++ {
+				if err := ch.Send(n, n != 10); err != nil {
+					errs <- err
+					return
+				}
+			}
+			var total float64
+			if _, err := ch.Recv(&total); err != nil {
+				errs <- err
+				return
+			}
+			if total != 55 {
+				errs <- fmt.Errorf("unexpected total: %v", total)
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for _, peer := range []*Peer{peer1, peer2} {
+		peer.mu.Lock()
+		pending := len(peer.repCh)
+		peer.mu.Unlock()
+		if pending != 0 {
+			t.Error("Unexpected pending channels:", pending)
+		}
+	}
+}
+
+func TestPendingCallFailsOnClose(t *testing.T) {
+	rpc := NewTestRPC()
+	started := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	rpc.Register("stuck", func(ch *Channel) error {
+		started <- true
+		<-release
+		return nil
+	})
+	_, client := NewPeerPair(rpc)
+	called := make(chan error)
+	go func() {
+		called <- client.Call("stuck", nil, new(interface{}))
+	}()
+	<-started
+	client.Close()
+	select {
+	case err := <-called:
+		if !errors.Is(err, ErrPeerClosed) {
+			t.Fatal("Expected ErrPeerClosed, got:", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Pending call not failed on close")
+	}
+	<-client.Done()
+	if !errors.Is(client.Err(), ErrPeerClosed) ||
+		!strings.Contains(client.Err().Error(), "Inbox closed") {
+		t.Fatal("Unexpected close reason:", client.Err())
+	}
+}
+
+func TestCloseWithRequestStreamOpen(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("first", func(ch *Channel) error {
+		var v interface{}
+		if _, err := ch.Recv(&v); err != nil {
+			return err
+		}
+		return ch.Send(v, false)
+	})
+	server, client := NewPeerPair(rpc)
+	ch := client.Open("first")
+	Fatal(ch.Send("hi", true), t)
+	var reply string
+	_, err := ch.Recv(&reply)
+	Fatal(err, t)
+	// the replies have ended but the request stream hasn't
+	server.Close()
+	client.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(1 * time.Second):
+		t.Fatal("Peer not done after close")
+	}
+}
+
+func TestCallAfterClose(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("echo", Echo)
+	server, client := NewPeerPair(rpc)
+	if server.Err() != nil {
+		t.Fatal("Unexpected error before close:", server.Err())
+	}
+	// nobody is listening on CloseNotify
+	client.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(1 * time.Second):
+		t.Fatal("Peer not done after close")
+	}
+	err := client.Call("echo", "hello", new(string))
+	if !errors.Is(err, ErrPeerClosed) {
+		t.Fatal("Expected ErrPeerClosed, got:", err)
+	}
+	var reply string
+	if _, err := client.Open("echo").Recv(&reply); !errors.Is(err, ErrPeerClosed) {
+		t.Fatal("Expected ErrPeerClosed, got:", err)
+	}
+}
+
+func TestChannelReadWriteCopy(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("cat", func(ch *Channel) error {
+		if _, err := io.Copy(ch, ch); err != nil {
+			return err
+		}
+		return ch.Close()
+	})
+	client, _ := NewPeerPair(rpc)
+	data := bytes.Repeat([]byte("duplex\x00\xff"), 10000)
+	ch := client.Open("cat")
+	go func() {
+		if _, err := io.Copy(ch, bytes.NewReader(data)); err != nil {
+			t.Error(err)
+		}
+		ch.Close()
+	}()
+	received, err := io.ReadAll(ch)
+	Fatal(err, t)
+	if !bytes.Equal(received, data) {
+		t.Fatal("Unexpected bytes received:", len(received))
+	}
+	if n, err := ch.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatal("Expected io.EOF after close, got:", n, err)
+	}
+}
@@ -0,0 +1,225 @@
+package duplex
+
+import (
+	"errors"
+	"reflect"
+	"time"
+)
+
+/*
+Flow control
+
+When the flow feature is negotiated, every streamed message
+(more=true) costs the sender one credit. Each side starts a
+channel with as many credits as the remote advertised as its
+window, and the receiver grants credits back with a TypeCredit
+message as its handler consumes the stream:
+
+	{"type": "cred", "method": "req", "id": 3, "payload": 32}
+
+Method names the stream being credited, so "req" credits the
+request stream of call 3 and "rep" its reply stream. The last
+message of a stream is always free, so an inbox of window+1
+never fills and a slow channel can't block the others.
+
+A side that stops reading a stream before it ends, because its
+handler returned or its call was abandoned, grants a credit of 0.
+The rest of the stream will be dropped, so sends on it fail with
+ErrStreamStopped instead of waiting for credit that won't come:
+
+	{"type": "cred", "method": "req", "id": 3, "payload": 0}
+*/
+
+var (
+	ErrWindowFull = errors.New("duplex: send window full")
+	// ErrStreamStopped is returned by sends on a stream the remote
+	// has stopped reading.
+	ErrStreamStopped = errors.New("duplex: remote stopped reading the stream")
+)
+
+// SetWindow enables flow control for connections this RPC makes
+// with Handshake, using a receive window of size messages per
+// channel. Accepted connections use flow control whenever the
+// client asks for it, with this window or BacklogSize if unset.
+func (rpc *RPC) SetWindow(size int) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.window = size
+}
+
+func (rpc *RPC) receiveWindow() int {
+	if rpc.window > 0 {
+		return rpc.window
+	}
+	return BacklogSize
+}
+
+func (peer *Peer) flow() bool {
+	return peer.sendWin > 0
+}
+
+// enqueue queues a message for a channel. With flow control a
+// full inbox means the remote ignored its credits, so the
+// message is dropped rather than stalling the route loop.
+func (peer *Peer) enqueue(ch *Channel, msg *Message) {
+	if !peer.flow() {
+		ch.inbox <- msg
+		return
+	}
+	select {
+	case ch.inbox <- msg:
+	default:
+		peer.log().Error("protocol error: flow control window exceeded",
+			"method", ch.method, "id", ch.id)
+	}
+}
+
+// credit applies a TypeCredit message to the stream it names.
+func (peer *Peer) credit(msg *Message) {
+	var ch *Channel
+	peer.mu.Lock()
+	switch msg.Method {
+	case TypeRequest:
+		ch = peer.repCh[msg.Id]
+	case TypeReply:
+		ch = peer.reqCh[msg.Id]
+	}
+	peer.mu.Unlock()
+	if ch == nil {
+		// stream already ended
+		return
+	}
+	if n := toInt(msg.Payload); n > 0 {
+		ch.addCredit(n)
+	} else {
+		ch.stop()
+	}
+}
+
+// SetSendTimeout bounds how long Send waits for credit when the
+// remote's window is full. Zero, the default, waits indefinitely.
+func (ch *Channel) SetSendTimeout(timeout time.Duration) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.sendTimeout = timeout
+}
+
+func (ch *Channel) addCredit(n int) {
+	ch.mu.Lock()
+	ch.credits += n
+	ch.mu.Unlock()
+	ch.wakeSender()
+}
+
+// stop fails the channel's sends now that the remote has stopped
+// reading them.
+func (ch *Channel) stop() {
+	ch.mu.Lock()
+	ch.stopped = true
+	ch.mu.Unlock()
+	ch.wakeSender()
+}
+
+func (ch *Channel) wakeSender() {
+	select {
+	case ch.creditCh <- struct{}{}:
+	default:
+	}
+}
+
+func (ch *Channel) acquireCredit() error {
+	if !ch.flow() || ch.id == 0 {
+		return nil
+	}
+	var timeout <-chan time.Time
+	for {
+		ch.mu.Lock()
+		if ch.stopped {
+			ch.mu.Unlock()
+			if ch.err != nil {
+				return ch.err
+			}
+			return ErrStreamStopped
+		}
+		if ch.credits > 0 {
+			ch.credits--
+			ch.mu.Unlock()
+			return nil
+		}
+		if timeout == nil && ch.sendTimeout > 0 {
+			timeout = time.After(ch.sendTimeout)
+		}
+		ch.mu.Unlock()
+		select {
+		case <-ch.creditCh:
+		case <-timeout:
+			return ErrWindowFull
+		case <-ch.closed:
+			return ch.Err()
+		}
+	}
+}
+
+// releaseCredit accounts for a consumed message, granting credits
+// back in batches of half the window.
+func (ch *Channel) releaseCredit() {
+	if !ch.flow() || ch.id == 0 {
+		return
+	}
+	ch.mu.Lock()
+	ch.consumed++
+	n := ch.consumed
+	if n < max(1, ch.window/2) {
+		ch.mu.Unlock()
+		return
+	}
+	ch.consumed = 0
+	ch.mu.Unlock()
+	ch.grantCredit(n)
+}
+
+// stopReading grants the remote a credit of 0 if its stream hasn't
+// ended, since no more of it will be read.
+func (ch *Channel) stopReading() {
+	if !ch.flow() || ch.id == 0 {
+		return
+	}
+	ch.mu.Lock()
+	ended := ch.recvClosed
+	ch.mu.Unlock()
+	if !ended {
+		ch.grantCredit(0)
+	}
+}
+
+func (ch *Channel) grantCredit(n int) {
+	stream := TypeReply
+	if ch.typ == TypeReply {
+		stream = TypeRequest
+	}
+	err := ch.writeMsg(&Message{
+		Type:    TypeCredit,
+		Method:  stream,
+		Id:      ch.id,
+		Payload: n,
+	})
+	if err != nil {
+		ch.log().Error("unable to grant credit",
+			"method", ch.method, "id", ch.id, "err", err)
+	}
+}
+
+// toInt converts a numeric payload of whatever type the codec
+// decoded it to.
+func toInt(v interface{}) int {
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.CanInt():
+		return int(rv.Int())
+	case rv.CanUint():
+		return int(rv.Uint())
+	case rv.CanFloat():
+		return int(rv.Float())
+	}
+	return 0
+}
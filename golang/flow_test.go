@@ -0,0 +1,157 @@
+package duplex
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandshakeNegotiatesFlow(t *testing.T) {
+	conn := NewMockConn()
+	defer conn.Close()
+	rpc := NewTestRPC()
+	rpc.SetWindow(4)
+	conn.inbox <- HandshakeAccept + ";flow=16"
+	peer, err := rpc.Handshake(conn)
+	Fatal(err, t)
+	if conn.sent[0].String() != Handshake("json")+";flow=4" {
+		t.Fatal("Unexpected handshake frame:", conn.sent[0].String())
+	}
+	if peer.window != 4 || peer.sendWin != 16 {
+		t.Fatal("Unexpected windows:", peer.window, peer.sendWin)
+	}
+}
+
+func TestAcceptNegotiatesFlow(t *testing.T) {
+	conn := NewMockConn()
+	defer conn.Close()
+	rpc := NewTestRPC()
+	conn.inbox <- Handshake("json") + ";flow=4"
+	peer, err := rpc.Accept(conn)
+	Fatal(err, t)
+	if conn.sent[0].String() != HandshakeAccept+";flow=1024" {
+		t.Fatal("Unexpected handshake response frame:", conn.sent[0].String())
+	}
+	if peer.window != BacklogSize || peer.sendWin != 4 {
+		t.Fatal("Unexpected windows:", peer.window, peer.sendWin)
+	}
+}
+
+func TestFlowSlowStreamDoesNotBlockPeer(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetWindow(4)
+	release := make(chan bool)
+	rpc.Register("slow-adder", func(ch *Channel) error {
+		<-release
+		return Adder(ch)
+	})
+	rpc.Register("echo", Echo)
+	conn1, conn2 := NewConnPair()
+	go rpc.Accept(conn1)
+	client, err := rpc.Handshake(conn2)
+	Fatal(err, t)
+
+	ch := client.Open("slow-adder")
+	sent := make(chan error, 1)
+	go func() {
+		for i := 1; i <= 20; i++ {
+			if err := ch.Send(i, i != 20); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+
+	var reply string
+	err = client.Call("echo", "unblocked", &reply)
+	Fatal(err, t)
+	if reply != "unblocked" {
+		t.Fatal("Unexpected reply:", reply)
+	}
+	select {
+	case <-sent:
+		t.Fatal("Send should block once the window is used up")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-sent:
+		Fatal(err, t)
+	case <-time.After(1 * time.Second):
+		t.Fatal("Send still blocked after handler caught up")
+	}
+	var total float64
+	_, err = ch.Recv(&total)
+	Fatal(err, t)
+	if total != 210 {
+		t.Fatal("Unexpected total:", total)
+	}
+}
+
+func TestFlowSendTimeout(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetWindow(2)
+	release := make(chan bool)
+	defer close(release)
+	rpc.Register("stuck", func(ch *Channel) error {
+		<-release
+		return nil
+	})
+	conn1, conn2 := NewConnPair()
+	go rpc.Accept(conn1)
+	client, err := rpc.Handshake(conn2)
+	Fatal(err, t)
+	ch := client.Open("stuck")
+	ch.SetSendTimeout(10 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		Fatal(ch.Send(i, true), t)
+	}
+	if err := ch.Send(2, true); err != ErrWindowFull {
+		t.Fatal("Expected ErrWindowFull, got:", err)
+	}
+	Fatal(ch.Send(3, false), t)
+}
+
+func TestFlowSendAfterHandlerReturns(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetWindow(2)
+	rpc.Register("first", func(ch *Channel) error {
+		var n int
+		if _, err := ch.Recv(&n); err != nil {
+			return err
+		}
+		return ch.Send(n, false)
+	})
+	server, client := NewPeerPair(rpc)
+	ch := client.Open("first")
+	Fatal(ch.Send(1, true), t)
+	var n int
+	_, err := ch.Recv(&n)
+	Fatal(err, t)
+	sent := make(chan error, 1)
+	go func() {
+		for i := 2; ; i++ {
+			if err := ch.Send(i, true); err != nil {
+				sent <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-sent:
+		if err != ErrStreamStopped {
+			t.Fatal("Expected ErrStreamStopped, got:", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Send blocked after the handler returned")
+	}
+	Fatal(ch.Close(), t)
+	waitFor(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return len(server.reqCh) == 0 && len(client.repCh) == 0
+	})
+}
@@ -0,0 +1,106 @@
+package duplex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+Framing
+
+Peers read and write whole frames. Stream transports like TCP,
+Unix sockets or stdio need framing added to carry them, either
+a 4 byte big endian length before each frame:
+
+	00 00 00 0e {"type":"req"}
+
+or a newline after each frame, which suits codecs like JSON
+that never put a newline inside one:
+
+	{"type":"req"}\n
+*/
+
+var ErrFrameTooLarge = errors.New("duplex: frame too large")
+
+type framedConn struct {
+	conn   io.ReadWriteCloser
+	reader *bufio.Reader
+	mu     sync.Mutex // serializes writes
+	lines  bool
+}
+
+// LengthFramed frames a stream transport with length prefixes.
+func LengthFramed(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	return &framedConn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// LineFramed frames a stream transport with newlines.
+func LineFramed(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	return &framedConn{conn: conn, reader: bufio.NewReader(conn), lines: true}
+}
+
+// Read reads one whole frame into p.
+func (f *framedConn) Read(p []byte) (int, error) {
+	if f.lines {
+		return f.readLine(p)
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(f.reader, header[:]); err != nil {
+		return 0, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if int64(size) > int64(len(p)) {
+		return 0, ErrFrameTooLarge
+	}
+	return io.ReadFull(f.reader, p[:size])
+}
+
+func (f *framedConn) readLine(p []byte) (int, error) {
+	n := 0
+	for {
+		chunk, err := f.reader.ReadSlice('\n')
+		if n+len(chunk) > len(p) {
+			return 0, ErrFrameTooLarge
+		}
+		n += copy(p[n:], chunk)
+		switch err {
+		case nil:
+			return n - 1, nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if n > 0 {
+				return n, nil
+			}
+		}
+		return 0, err
+	}
+}
+
+// Write writes p as one frame.
+func (f *framedConn) Write(p []byte) (int, error) {
+	var frame []byte
+	if f.lines {
+		if bytes.IndexByte(p, '\n') >= 0 {
+			return 0, errors.New("duplex: newline in line framed frame")
+		}
+		frame = append(append(frame, p...), '\n')
+	} else {
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(p)))
+		frame = append(frame, p...)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *framedConn) Close() error {
+	return f.conn.Close()
+}
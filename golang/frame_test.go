@@ -0,0 +1,45 @@
+package duplex
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestFramedPeers(t *testing.T) {
+	for name, framing := range map[string]func(io.ReadWriteCloser) io.ReadWriteCloser{
+		"length": LengthFramed,
+		"line":   LineFramed,
+	} {
+		t.Run(name, func(t *testing.T) {
+			rpc := NewTestRPC()
+			rpc.Register("echo", Echo)
+			conn1, conn2 := net.Pipe()
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rpc.Accept(framing(conn1))
+			}()
+			client, err := rpc.Handshake(framing(conn2))
+			Fatal(err, t)
+			wg.Wait()
+			var reply string
+			Fatal(client.Call("echo", "line\none", &reply), t)
+			if reply != "line\none" {
+				t.Fatalf("Unexpected reply: %q", reply)
+			}
+			client.Close()
+		})
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	go LengthFramed(conn1).Write(make([]byte, 64))
+	if _, err := LengthFramed(conn2).Read(make([]byte, 32)); err != ErrFrameTooLarge {
+		t.Fatal("Expected frame too large, got:", err)
+	}
+	conn1.Close()
+}
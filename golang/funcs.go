@@ -0,0 +1,193 @@
+package duplex
+
+import (
+	"fmt"
+	"reflect"
+)
+
+/*
+Func values
+
+Funcs in a payload are sent as references to callbacks on the
+sending peer, and references received decode as a RemoteFunc
+that calls back to it:
+
+	-> {"method": "subscribe", "payload": {"topic": "news",
+	    "notify": {"$callback": "_callback.8b1d..."}}}
+	<- {"method": "_callback.8b1d...", "payload": "headline"}
+
+Funcs are found at the top of the payload and inside slices and
+maps with interface or func elements, not in struct fields. A
+func can take the call's arguments and the *Channel and return a
+result and an error, each optionally.
+
+Callbacks made from funcs in a call's arguments are revoked once
+the call's replies end, so a remote holding on to one for longer,
+like a subscription, should be sent a *Callback from Peer.Callback
+instead. Those made from funcs in replies and notifications last
+as long as the peer, unless sent as a *Callback with limits.
+*/
+
+// CallbackRefKey is the only key of a callback reference object.
+var CallbackRefKey = "$callback"
+
+// RemoteFunc calls a callback on the peer that sent it. With a
+// nil reply the call is a notification.
+type RemoteFunc func(args interface{}, reply interface{}) error
+
+var (
+	channelType = reflect.TypeOf((*Channel)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// marshalFuncs replaces the funcs in v with callback references,
+// tying the callbacks to the channel's call if it has one.
+func (ch *Channel) marshalFuncs(v interface{}) (interface{}, error) {
+	switch fn := v.(type) {
+	case *Callback:
+		return map[string]interface{}{CallbackRefKey: fn.Name}, nil
+	case RemoteFunc:
+		// passed on, so calls are relayed to where it came from
+		return ch.marshalFuncs(ch.funcCallback(func(args interface{}, _ *Channel) (interface{}, error) {
+			var reply interface{}
+			err := fn(args, &reply)
+			return reply, err
+		}))
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Func:
+		if value.IsNil() {
+			return nil, nil
+		}
+		fn, err := reflectFunc(value)
+		if err != nil {
+			return nil, err
+		}
+		return ch.marshalFuncs(ch.funcCallback(fn))
+	case reflect.Slice, reflect.Array:
+		if !mayHoldFunc(value.Type().Elem()) {
+			return v, nil
+		}
+		if value.Kind() == reflect.Slice && value.IsNil() {
+			return v, nil
+		}
+		list := make([]interface{}, value.Len())
+		for i := range list {
+			elem, err := ch.marshalFuncs(value.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			list[i] = elem
+		}
+		return list, nil
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String || !mayHoldFunc(value.Type().Elem()) {
+			return v, nil
+		}
+		if value.IsNil() {
+			return v, nil
+		}
+		obj := make(map[string]interface{}, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			elem, err := ch.marshalFuncs(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			obj[iter.Key().String()] = elem
+		}
+		return obj, nil
+	}
+	return v, nil
+}
+
+// funcCallback registers a callback for a func in a payload. One
+// sent with a call lasts until the call ends.
+func (ch *Channel) funcCallback(fn func(interface{}, *Channel) (interface{}, error)) *Callback {
+	cb := ch.Callback(fn)
+	if ch.typ == TypeRequest && ch.id != 0 {
+		ch.mu.Lock()
+		ch.callbacks = append(ch.callbacks, cb)
+		ch.mu.Unlock()
+	}
+	return cb
+}
+
+// revokeCallbacks revokes the callbacks sent with a call that
+// has ended.
+func (ch *Channel) revokeCallbacks() {
+	ch.mu.Lock()
+	callbacks := ch.callbacks
+	ch.callbacks = nil
+	ch.mu.Unlock()
+	for _, cb := range callbacks {
+		cb.Revoke()
+	}
+}
+
+func mayHoldFunc(t reflect.Type) bool {
+	return t.Kind() == reflect.Interface || t.Kind() == reflect.Func
+}
+
+// reflectFunc adapts a func of any supported signature to the
+// form taken by Peer.Callback.
+func reflectFunc(fn reflect.Value) (func(interface{}, *Channel) (interface{}, error), error) {
+	t := fn.Type()
+	in, out := t.NumIn(), t.NumOut()
+	withChannel := in > 0 && t.In(in-1) == channelType
+	if withChannel {
+		in--
+	}
+	withError := out > 0 && t.Out(out-1) == errorType
+	if withError {
+		out--
+	}
+	if in > 1 || out > 1 || t.IsVariadic() {
+		return nil, fmt.Errorf("duplex: unsupported callback type %s", t)
+	}
+	return func(args interface{}, ch *Channel) (interface{}, error) {
+		var params []reflect.Value
+		if in == 1 {
+			arg := reflect.New(t.In(0))
+			if err := ch.decode(args, arg.Interface()); err != nil {
+				return nil, err
+			}
+			params = append(params, arg.Elem())
+		}
+		if withChannel {
+			params = append(params, reflect.ValueOf(ch))
+		}
+		results := fn.Call(params)
+		if withError {
+			if err := results[out]; !err.IsNil() {
+				return nil, err.Interface().(error)
+			}
+		}
+		if out == 1 {
+			return results[0].Interface(), nil
+		}
+		return nil, nil
+	}, nil
+}
+
+// unmarshalFuncs replaces callback references in a decoded payload
+// with funcs calling back to the peer, modifying it in place.
+func (peer *Peer) unmarshalFuncs(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if name, ok := value[CallbackRefKey].(string); ok && len(value) == 1 {
+			return RemoteFunc(func(args interface{}, reply interface{}) error {
+				return peer.Call(name, args, reply)
+			})
+		}
+		for key, elem := range value {
+			value[key] = peer.unmarshalFuncs(elem)
+		}
+	case []interface{}:
+		for i, elem := range value {
+			value[i] = peer.unmarshalFuncs(elem)
+		}
+	}
+	return v
+}
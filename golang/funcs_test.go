@@ -0,0 +1,95 @@
+package duplex
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFuncArgumentsBecomeCallbacks(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.RegisterFunc("apply", func(arg interface{}, ch *Channel) (interface{}, error) {
+		args := arg.(map[string]interface{})
+		fn, ok := args["fn"].(RemoteFunc)
+		if !ok {
+			t.Errorf("Unexpected fn: %#v", args["fn"])
+			return nil, nil
+		}
+		var ret interface{}
+		err := fn(args["value"], &ret)
+		return ret, err
+	})
+	server, client := NewPeerPair(rpc)
+	var reply string
+	err := client.Call("apply", map[string]interface{}{
+		"value": "hello",
+		"fn":    strings.ToUpper,
+	}, &reply)
+	Fatal(err, t)
+	if reply != "HELLO" {
+		t.Fatal("Unexpected reply:", reply)
+	}
+
+	// and in the other direction, as a reply
+	rpc.RegisterFunc("adder", func(arg interface{}, ch *Channel) (interface{}, error) {
+		base := arg.(float64)
+		return func(n float64) (float64, error) {
+			return base + n, nil
+		}, nil
+	})
+	var add RemoteFunc
+	Fatal(server.Call("adder", 10, &add), t)
+	var sum float64
+	Fatal(add(5, &sum), t)
+	if sum != 15 {
+		t.Fatal("Unexpected sum:", sum)
+	}
+}
+
+func TestFuncArgumentsInLists(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.RegisterFunc("callAll", func(arg interface{}, ch *Channel) (interface{}, error) {
+		for _, fn := range arg.([]interface{}) {
+			if err := fn.(RemoteFunc)(nil, new(interface{})); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	_, client := NewPeerPair(rpc)
+	called := 0
+	count := func() { called++ }
+	var reply interface{}
+	Fatal(client.Call("callAll", []interface{}{count, count}, &reply), t)
+	if called != 2 {
+		t.Fatal("Unexpected number of calls:", called)
+	}
+}
+
+func TestUnsupportedFuncArgument(t *testing.T) {
+	rpc := NewTestRPC()
+	_, client := NewPeerPair(rpc)
+	err := client.Call("anything", func(a, b int) {}, new(interface{}))
+	if err == nil || !strings.Contains(err.Error(), "unsupported callback type") {
+		t.Fatal("Expected unsupported callback error, got:", err)
+	}
+}
+
+func TestFuncCallbacksEndWithCall(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.RegisterFunc("apply", func(arg interface{}, ch *Channel) (interface{}, error) {
+		var ret interface{}
+		err := arg.(RemoteFunc)("hello", &ret)
+		return ret, err
+	})
+	_, client := NewPeerPair(rpc)
+	for i := 0; i < 3; i++ {
+		var reply string
+		Fatal(client.Call("apply", strings.ToUpper, &reply), t)
+		client.mu.Lock()
+		n := len(client.callbacks)
+		client.mu.Unlock()
+		if n != 0 {
+			t.Fatal("Callbacks left after call:", n)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package duplex
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+/*
+Gateway
+
+A gateway relays calls between the peers connected to it, so
+clients that can't reach each other directly, like browsers, can
+still call each other. A peer claims names by calling
+gateway.register, and calls to name.method from any other peer
+are forwarded to it as method:
+
+	A -> gateway  {"method": "gateway.register", "payload": "alice"}
+	B -> gateway  {"method": "alice.msgbox", "id": 4, "payload": "hi"}
+	gateway -> A  {"method": "msgbox", "id": 9, "payload": "hi"}
+	A -> gateway  {"type": "rep", "id": 9, "payload": "ok"}
+	gateway -> B  {"type": "rep", "id": 4, "payload": "ok"}
+
+Each side of a forwarded call keeps its own ids. Streams are
+relayed message by message in both directions, and callbacks in
+payloads are relayed as callbacks on the gateway. A peer's names
+are released when it closes.
+*/
+
+// ErrCodeNameTaken is returned when registering a gateway name
+// another peer holds.
+const ErrCodeNameTaken = -32002
+
+// Gateway routes calls between the peers of an RPC by name.
+type Gateway struct {
+	rpc *RPC
+
+	mu     sync.Mutex
+	routes map[string]*Peer
+	peers  map[*Peer]bool // peers watched for closing
+}
+
+// NewGateway makes rpc a gateway. It registers gateway.register
+// and gateway.unregister and forwards calls to methods rpc doesn't
+// otherwise handle.
+func NewGateway(rpc *RPC) *Gateway {
+	gw := &Gateway{
+		rpc:    rpc,
+		routes: make(map[string]*Peer),
+		peers:  make(map[*Peer]bool),
+	}
+	rpc.RegisterFunc("gateway.register", func(args interface{}, ch *Channel) (interface{}, error) {
+		name, _ := args.(string)
+		return nil, gw.Route(name, ch.Peer)
+	}, MethodDoc("Routes calls to name.method to the caller."), MethodArgs(""))
+	rpc.RegisterFunc("gateway.unregister", func(args interface{}, ch *Channel) (interface{}, error) {
+		name, _ := args.(string)
+		gw.mu.Lock()
+		defer gw.mu.Unlock()
+		if gw.routes[name] == ch.Peer {
+			delete(gw.routes, name)
+		}
+		return nil, nil
+	}, MethodDoc("Releases a name registered by the caller."), MethodArgs(""))
+	rpc.RegisterDefault(gw.forward)
+	return gw
+}
+
+// Accept accepts a peer connecting to the gateway.
+func (gw *Gateway) Accept(conn io.ReadWriteCloser) (*Peer, error) {
+	return gw.rpc.Accept(conn)
+}
+
+// Route sends calls to name.method to peer until the name is
+// released or the peer closes.
+func (gw *Gateway) Route(name string, peer *Peer) error {
+	if name == "" || strings.Contains(name, ".") {
+		return &Error{Code: ErrCodeInternal, Message: "invalid gateway name: " + name}
+	}
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if owner, taken := gw.routes[name]; taken && owner != peer {
+		return &Error{Code: ErrCodeNameTaken, Message: "gateway name taken: " + name}
+	}
+	gw.routes[name] = peer
+	if !gw.peers[peer] {
+		gw.peers[peer] = true
+		go gw.release(peer)
+	}
+	return nil
+}
+
+// release drops a peer's names once it closes.
+func (gw *Gateway) release(peer *Peer) {
+	<-peer.Done()
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	for name, owner := range gw.routes {
+		if owner == peer {
+			delete(gw.routes, name)
+		}
+	}
+	delete(gw.peers, peer)
+}
+
+// forward relays a call for name.method to the peer with name.
+func (gw *Gateway) forward(in *Channel) error {
+	name, method, _ := strings.Cut(in.method, ".")
+	gw.mu.Lock()
+	target := gw.routes[name]
+	gw.mu.Unlock()
+	if target == nil || method == "" {
+		if in.id == 0 {
+			return nil
+		}
+		return in.SendErr(ErrCodeMethodNotFound, "method not found: "+in.method, nil)
+	}
+	if in.id == 0 {
+		msg, err := in.recvMsg()
+		if msg == nil {
+			return err
+		}
+		return target.Call(method, msg.Payload, nil)
+	}
+	out := target.Open(method)
+	if ext := in.getExt(); ext != nil {
+		out.SetExt(ext)
+	}
+	r := &relay{in: in, out: out}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	defer r.cancel()
+	go r.requests()
+	return r.replies()
+}
+
+// relay splices the streams of a forwarded call. Only replies
+// answers the caller, so it's answered once.
+type relay struct {
+	in, out *Channel
+	ctx     context.Context
+	cancel  context.CancelFunc
+	err     error // why requests stopped early, set before cancel
+}
+
+func (r *relay) requests() {
+	for {
+		msg, err := r.in.recvMsg()
+		if msg == nil {
+			if err != nil {
+				// the caller is gone, so end its stream
+				r.out.Send(nil, false)
+				r.stop(err)
+			}
+			return
+		}
+		if err := r.out.Send(msg.Payload, msg.More); err != nil {
+			r.stop(err)
+			return
+		}
+		if !msg.More {
+			return
+		}
+	}
+}
+
+// stop ends the relay early, dropping any further replies.
+func (r *relay) stop(err error) {
+	r.err = err
+	r.cancel()
+}
+
+func (r *relay) replies() error {
+	for {
+		msg, err := r.out.recvMsgContext(r.ctx)
+		if msg == nil {
+			if r.ctx.Err() != nil {
+				r.out.abandon()
+				err = r.err
+			}
+			if err != nil {
+				return r.in.sendError(err)
+			}
+			return nil
+		}
+		if err := r.in.Send(msg.Payload, msg.More); err != nil || !msg.More {
+			return err
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package duplex
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// gatewayClient connects a new client peer to the gateway and
+// returns it with the gateway's side of the connection.
+func gatewayClient(t *testing.T, gw *Gateway) (*Peer, *Peer) {
+	conn1, conn2 := NewConnPair()
+	accepted := make(chan *Peer)
+	go func() {
+		peer, err := gw.Accept(conn1)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- peer
+	}()
+	peer, err := NewTestRPC().Handshake(conn2)
+	Fatal(err, t)
+	return peer, <-accepted
+}
+
+func TestGatewayForwardsCalls(t *testing.T) {
+	gw := NewGateway(NewTestRPC())
+	alice, _ := gatewayClient(t, gw)
+	bob, _ := gatewayClient(t, gw)
+	alice.Register("msgbox", func(ch *Channel) error {
+		var text string
+		if _, err := ch.Recv(&text); err != nil {
+			return err
+		}
+		return ch.Send("alice saw "+text, false)
+	})
+	alice.Register("count", Generator)
+	alice.Register("fail", func(ch *Channel) error {
+		return ch.SendErr(TestErrorCode, TestErrorMessage, nil)
+	})
+	Fatal(alice.Call("gateway.register", "alice", nil), t)
+	var reply string
+	Fatal(alice.Call("gateway.register", "alice", &reply), t)
+
+	Fatal(bob.Call("alice.msgbox", "hi", &reply), t)
+	if reply != "alice saw hi" {
+		t.Fatal("Unexpected reply:", reply)
+	}
+
+	ch := bob.Open("alice.count")
+	Fatal(ch.Send(3, false), t)
+	var nums []float64
+	for value, err := range Stream[map[string]float64](ch) {
+		Fatal(err, t)
+		nums = append(nums, value["num"])
+	}
+	if !slices.Equal(nums, []float64{1, 2, 3}) {
+		t.Fatal("Unexpected stream:", nums)
+	}
+
+	err := bob.Call("alice.fail", nil, &reply)
+	if rpcError, ok := err.(*Error); !ok || rpcError.Code != TestErrorCode {
+		t.Fatal("Expected relayed error, got:", err)
+	}
+	err = bob.Call("carol.msgbox", "hi", &reply)
+	if rpcError, ok := err.(*Error); !ok || rpcError.Code != ErrCodeMethodNotFound {
+		t.Fatal("Expected method not found, got:", err)
+	}
+}
+
+func TestGatewayForwardedFuncsEndWithCall(t *testing.T) {
+	gw := NewGateway(NewTestRPC())
+	alice, gwAlice := gatewayClient(t, gw)
+	bob, gwBob := gatewayClient(t, gw)
+	alice.Register("apply", funcHandler(func(arg interface{}, ch *Channel) (interface{}, error) {
+		var ret interface{}
+		err := arg.(RemoteFunc)("hello", &ret)
+		return ret, err
+	}))
+	Fatal(alice.Call("gateway.register", "alice", new(interface{})), t)
+	for i := 0; i < 3; i++ {
+		var reply string
+		Fatal(bob.Call("alice.apply", strings.ToUpper, &reply), t)
+		if reply != "HELLO" {
+			t.Fatal("Unexpected reply:", reply)
+		}
+	}
+	// the gateway's relay callbacks go once the forwarded call ends,
+	// which may be just after bob's reply arrives
+	waitFor(t, func() bool {
+		count := 0
+		for _, peer := range []*Peer{bob, gwAlice, gwBob} {
+			peer.mu.Lock()
+			count += len(peer.callbacks)
+			peer.mu.Unlock()
+		}
+		return count == 0
+	})
+}
+
+func TestGatewayNames(t *testing.T) {
+	gw := NewGateway(NewTestRPC())
+	alice, aliceConn := gatewayClient(t, gw)
+	bob, _ := gatewayClient(t, gw)
+	Fatal(alice.Call("gateway.register", "alice", new(interface{})), t)
+	err := bob.Call("gateway.register", "alice", new(interface{}))
+	if rpcError, ok := err.(*Error); !ok || rpcError.Code != ErrCodeNameTaken {
+		t.Fatal("Expected name taken, got:", err)
+	}
+	aliceConn.Close()
+	waitFor(t, func() bool {
+		gw.mu.Lock()
+		defer gw.mu.Unlock()
+		return gw.routes["alice"] == nil
+	})
+	Fatal(bob.Call("gateway.register", "alice", new(interface{})), t)
+	Fatal(bob.Call("gateway.unregister", "alice", new(interface{})), t)
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if len(gw.routes) != 0 {
+		t.Fatal("Unexpected routes:", gw.routes)
+	}
+}
+
+func TestGatewayRelaysCallbacks(t *testing.T) {
+	gw := NewGateway(NewTestRPC())
+	alice, _ := gatewayClient(t, gw)
+	bob, _ := gatewayClient(t, gw)
+	alice.Register("apply", funcHandler(func(args interface{}, ch *Channel) (interface{}, error) {
+		var reply interface{}
+		err := args.(RemoteFunc)("from alice", &reply)
+		return reply, err
+	}))
+	Fatal(alice.Call("gateway.register", "alice", new(interface{})), t)
+	var reply string
+	Fatal(bob.Call("alice.apply", func(s string) string { return "bob got " + s }, &reply), t)
+	if reply != "bob got from alice" {
+		t.Fatal("Unexpected reply:", reply)
+	}
+}
@@ -0,0 +1,119 @@
+package duplex
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+Heartbeats
+
+With the ping feature negotiated, either side may send pings at
+an interval. The remote answers each with a pong carrying the
+same payload:
+
+	{"type": "ping", "payload": 7}
+	{"type": "pong", "payload": 7}
+
+Any frame from the remote counts as a sign of life. A peer that
+has been silent for longer than the timeout is closed with
+ErrHeartbeatTimeout.
+*/
+
+var ErrHeartbeatTimeout = errors.New("duplex: heartbeat timeout")
+
+// SetHeartbeat enables heartbeats for connections made with this
+// RPC. Clients ask for the ping feature in the handshake, which
+// servers always accept. A timeout of zero means three intervals.
+func (rpc *RPC) SetHeartbeat(interval, timeout time.Duration) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.heartbeat, rpc.heartbeatTimeout = interval, timeout
+}
+
+// SetHeartbeat starts pinging the remote every interval, closing
+// the peer if nothing is heard from it within timeout, or three
+// intervals if timeout is zero. An interval of zero stops the
+// heartbeat. It fails if the ping feature wasn't negotiated.
+func (peer *Peer) SetHeartbeat(interval, timeout time.Duration) error {
+	if !peer.pings {
+		return errors.New("duplex: remote does not support " + FeaturePing)
+	}
+	if timeout == 0 {
+		timeout = 3 * interval
+	}
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.stopPings != nil {
+		close(peer.stopPings)
+		peer.stopPings = nil
+	}
+	if interval > 0 {
+		peer.stopPings = make(chan struct{})
+		peer.lastSeen.Store(time.Now().UnixNano())
+		go peer.heartbeat(interval, timeout, peer.stopPings)
+	}
+	return nil
+}
+
+// RTT returns the round trip time measured by the last answered
+// ping, or zero if there hasn't been one.
+func (peer *Peer) RTT() time.Duration {
+	return time.Duration(peer.rtt.Load())
+}
+
+func (peer *Peer) heartbeat(interval, timeout time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			silent := time.Since(time.Unix(0, peer.lastSeen.Load()))
+			if silent > timeout {
+				peer.log().Warn("heartbeat timeout", "silent", silent)
+				peer.closeWith(ErrHeartbeatTimeout)
+				return
+			}
+			peer.ping()
+		case <-stop:
+			return
+		case <-peer.closed:
+			return
+		}
+	}
+}
+
+// ping sends a new ping unless the last is still unanswered, so
+// a round trip longer than the interval can still be measured.
+func (peer *Peer) ping() {
+	peer.mu.Lock()
+	if peer.pingPending {
+		peer.mu.Unlock()
+		return
+	}
+	peer.pingPending = true
+	peer.pingNonce++
+	nonce := peer.pingNonce
+	peer.pingSent = time.Now()
+	peer.mu.Unlock()
+	if err := peer.writeMsg(&Message{Type: TypePing, Payload: nonce}); err != nil {
+		peer.log().Error("unable to send ping", "err", err)
+	}
+}
+
+func (peer *Peer) pong(msg *Message) {
+	if err := peer.writeMsg(&Message{Type: TypePong, Payload: msg.Payload}); err != nil {
+		peer.log().Error("unable to send pong", "err", err)
+	}
+}
+
+// measure takes the round trip time from a pong answering the
+// latest ping. Pongs for earlier pings are ignored.
+func (peer *Peer) measure(msg *Message) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if nonce := toInt(msg.Payload); nonce != 0 && nonce == peer.pingNonce {
+		peer.rtt.Store(int64(time.Since(peer.pingSent)))
+		peer.pingPending = false
+	}
+}
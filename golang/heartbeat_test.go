@@ -0,0 +1,50 @@
+package duplex
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatMeasuresRTT(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetHeartbeat(2*time.Millisecond, time.Second)
+	server, client := NewPeerPair(rpc)
+	waitFor(t, func() bool {
+		return client.RTT() > 0 && server.RTT() > 0
+	})
+	if client.Err() != nil || server.Err() != nil {
+		t.Fatal("Unexpected close:", client.Err(), server.Err())
+	}
+}
+
+func TestHeartbeatTimeoutClosesPeer(t *testing.T) {
+	conn := NewMockConn()
+	rpc := NewTestRPC()
+	rpc.SetHeartbeat(2*time.Millisecond, 10*time.Millisecond)
+	conn.inbox <- HandshakeAccept + ";ping"
+	peer, err := rpc.Handshake(conn)
+	Fatal(err, t)
+	conn.Lock()
+	handshake := conn.sent[0].String()
+	conn.Unlock()
+	if handshake != Handshake("json")+";ping" {
+		t.Fatal("Unexpected handshake frame:", handshake)
+	}
+	select {
+	case <-peer.Done():
+	case <-time.After(1 * time.Second):
+		t.Fatal("Silent peer not closed")
+	}
+	if !errors.Is(peer.Err(), ErrHeartbeatTimeout) {
+		t.Fatal("Unexpected close reason:", peer.Err())
+	}
+}
+
+func TestHeartbeatRequiresFeature(t *testing.T) {
+	rpc := NewTestRPC()
+	_, client := NewPeerPair(rpc)
+	if err := client.SetHeartbeat(time.Millisecond, 0); err == nil {
+		t.Fatal("Expected error without negotiated ping feature")
+	}
+}
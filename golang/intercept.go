@@ -0,0 +1,73 @@
+package duplex
+
+import (
+	"golang.org/x/net/context"
+)
+
+/*
+Call middleware
+
+Outbound calls made with Call and CallContext pass through call
+middleware before reaching the remote, so policies like retries
+can wrap them. Middleware added to an RPC applies to peers made
+after, and to calls made through a PeerPool it applies to each
+pool call as a whole, around the choice of peer.
+*/
+
+// Invoker makes an outbound call.
+type Invoker func(ctx context.Context, method string, args interface{}, reply interface{}) error
+
+// CallMiddleware wraps outbound calls.
+type CallMiddleware func(next Invoker) Invoker
+
+// UseCall adds call middleware for peers created after the call.
+// The first middleware added is the outermost.
+func (rpc *RPC) UseCall(middleware ...CallMiddleware) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.callMiddleware = append(rpc.callMiddleware[:len(rpc.callMiddleware):len(rpc.callMiddleware)], middleware...)
+}
+
+// UseCall adds call middleware for calls made on this peer.
+func (peer *Peer) UseCall(middleware ...CallMiddleware) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.callMiddleware = append(peer.callMiddleware[:len(peer.callMiddleware):len(peer.callMiddleware)], middleware...)
+}
+
+func (peer *Peer) invoker() Invoker {
+	peer.mu.Lock()
+	middleware := peer.callMiddleware
+	peer.mu.Unlock()
+	if len(middleware) == 0 {
+		return peer.call
+	}
+	invoke := chain(peer.call, middleware)
+	return func(ctx context.Context, method string, args interface{}, reply interface{}) error {
+		return invoke(context.WithValue(ctx, peerKey{}, peer), method, args, reply)
+	}
+}
+
+type peerKey struct{}
+
+// ContextPeer returns the peer making a call, for call middleware
+// that tracks peers separately. It's nil for calls on a PeerPool
+// before a peer is chosen.
+func ContextPeer(ctx context.Context) *Peer {
+	peer, _ := ctx.Value(peerKey{}).(*Peer)
+	return peer
+}
+
+// UseCall adds call middleware for calls made through the pool.
+func (pool *PeerPool) UseCall(middleware ...CallMiddleware) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.callMiddleware = append(pool.callMiddleware[:len(pool.callMiddleware):len(pool.callMiddleware)], middleware...)
+}
+
+func chain(invoke Invoker, middleware []CallMiddleware) Invoker {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		invoke = middleware[i](invoke)
+	}
+	return invoke
+}
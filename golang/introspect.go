@@ -0,0 +1,272 @@
+package duplex
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+/*
+Introspection
+
+Every peer answers a few reserved methods describing what it
+offers, so services are self documenting and generic clients
+can discover them:
+
+	duplex.methods   -> [{"name": "echo", "doc": "..."}, ...]
+	duplex.describe  "echo" -> {"name": "echo", "args": {...}}
+	duplex.identity  -> the value given to RPC.SetIdentity
+
+Argument and reply schemas are JSON Schema documents derived
+from example values given at registration.
+*/
+
+// BuiltinPrefix starts the names of the reserved methods.
+var BuiltinPrefix = "duplex."
+
+// MethodInfo describes a method for introspection.
+type MethodInfo struct {
+	Name        string                 `json:"name"`
+	Doc         string                 `json:"doc,omitempty"`
+	Args        map[string]interface{} `json:"args,omitempty"`
+	Reply       map[string]interface{} `json:"reply,omitempty"`
+	StreamArgs  bool                   `json:"streamArgs,omitempty"`
+	StreamReply bool                   `json:"streamReply,omitempty"`
+	Idempotent  bool                   `json:"idempotent,omitempty"`
+}
+
+type MethodOption func(*MethodInfo)
+
+// MethodDoc documents what a method does.
+func MethodDoc(doc string) MethodOption {
+	return func(info *MethodInfo) {
+		info.Doc = doc
+	}
+}
+
+// MethodArgs describes a method's arguments by an example value.
+func MethodArgs(example interface{}) MethodOption {
+	return func(info *MethodInfo) {
+		info.Args = schemaOf(reflect.TypeOf(example), nil)
+	}
+}
+
+// MethodReply describes a method's reply by an example value.
+func MethodReply(example interface{}) MethodOption {
+	return func(info *MethodInfo) {
+		info.Reply = schemaOf(reflect.TypeOf(example), nil)
+	}
+}
+
+// MethodStreaming marks the arguments and the reply of a method
+// as streams of values.
+func MethodStreaming(args, reply bool) MethodOption {
+	return func(info *MethodInfo) {
+		info.StreamArgs, info.StreamReply = args, reply
+	}
+}
+
+// MethodIdempotent marks a method as safe to call more than once
+// with the same arguments.
+func MethodIdempotent() MethodOption {
+	return func(info *MethodInfo) {
+		info.Idempotent = true
+	}
+}
+
+func methodInfo(name string, opts []MethodOption) *MethodInfo {
+	info := &MethodInfo{Name: name}
+	for _, opt := range opts {
+		opt(info)
+	}
+	return info
+}
+
+// SetIdentity sets the value returned by duplex.identity, such as
+// the name and version of the service.
+func (rpc *RPC) SetIdentity(identity interface{}) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.identity = identity
+}
+
+// Methods describes the methods resolved by this RPC, including
+// those of its mounts, sorted by name.
+func (rpc *RPC) Methods() []MethodInfo {
+	methods := rpc.methods("")
+	sortMethods(methods)
+	return methods
+}
+
+func (rpc *RPC) methods(prefix string) []MethodInfo {
+	rpc.Lock()
+	var methods []MethodInfo
+	for name := range rpc.registered {
+		methods = append(methods, describe(prefix+name, rpc.info[name]))
+	}
+	mounts := make(map[string]*RPC, len(rpc.mounts))
+	for name, sub := range rpc.mounts {
+		mounts[name] = sub
+	}
+	rpc.Unlock()
+	for name, sub := range mounts {
+		methods = append(methods, sub.methods(prefix+name+".")...)
+	}
+	return methods
+}
+
+func describe(name string, info *MethodInfo) MethodInfo {
+	if info == nil {
+		return MethodInfo{Name: name}
+	}
+	described := *info
+	described.Name = name
+	return described
+}
+
+func sortMethods(methods []MethodInfo) {
+	sort.Slice(methods, func(i, j int) bool {
+		return methods[i].Name < methods[j].Name
+	})
+}
+
+// methods describes everything the remote can call on this peer
+// except callbacks. Methods registered on the peer hide those of
+// the RPC with the same name.
+func (peer *Peer) methods() []MethodInfo {
+	methods := builtinMethods()
+	seen := make(map[string]bool)
+	peer.mu.Lock()
+	for name := range peer.registered {
+		methods = append(methods, describe(name, peer.info[name]))
+		seen[name] = true
+	}
+	peer.mu.Unlock()
+	for _, info := range peer.rpc.methods("") {
+		if !seen[info.Name] && !strings.HasPrefix(info.Name, BuiltinPrefix) {
+			methods = append(methods, info)
+		}
+	}
+	sortMethods(methods)
+	return methods
+}
+
+func builtinMethods() []MethodInfo {
+	return []MethodInfo{{
+		Name:       BuiltinPrefix + "methods",
+		Doc:        "Lists the methods offered by this peer.",
+		Reply:      schemaOf(reflect.TypeOf([]MethodInfo{}), nil),
+		Idempotent: true,
+	}, {
+		Name:       BuiltinPrefix + "describe",
+		Doc:        "Describes the method named by the argument.",
+		Args:       schemaOf(reflect.TypeOf(""), nil),
+		Reply:      schemaOf(reflect.TypeOf(MethodInfo{}), nil),
+		Idempotent: true,
+	}, {
+		Name:       BuiltinPrefix + "identity",
+		Doc:        "Returns the identity of this peer's service.",
+		Idempotent: true,
+	}}
+}
+
+// builtin returns the handler for a reserved method, or nil.
+func (peer *Peer) builtin(method string) func(*Channel) error {
+	name, reserved := strings.CutPrefix(method, BuiltinPrefix)
+	if !reserved {
+		return nil
+	}
+	switch name {
+	case "methods":
+		return funcHandler(func(interface{}, *Channel) (interface{}, error) {
+			return peer.methods(), nil
+		})
+	case "describe":
+		return func(ch *Channel) error {
+			var name string
+			if _, err := ch.Recv(&name); err != nil {
+				return err
+			}
+			for _, info := range peer.methods() {
+				if info.Name == name {
+					return ch.Send(info, false)
+				}
+			}
+			return ch.SendErr(ErrCodeMethodNotFound, "method not found: "+name, nil)
+		}
+	case "identity":
+		return funcHandler(func(interface{}, *Channel) (interface{}, error) {
+			peer.rpc.Lock()
+			defer peer.rpc.Unlock()
+			return peer.rpc.identity, nil
+		})
+	}
+	return nil
+}
+
+// RemoteMethods asks the remote for the methods it offers.
+func (peer *Peer) RemoteMethods(ctx context.Context) ([]MethodInfo, error) {
+	var methods []MethodInfo
+	err := peer.CallContext(ctx, BuiltinPrefix+"methods", nil, &methods)
+	return methods, err
+}
+
+// schemaOf derives a JSON Schema for values of type t as encoded
+// by encoding/json. Types already being described are left open
+// so recursive types terminate.
+func schemaOf(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Func:
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{CallbackRefKey: map[string]interface{}{"type": "string"}},
+		}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		if seen == nil {
+			seen = make(map[reflect.Type]bool)
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaOf(field.Type, seen)
+		}
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,105 @@
+package duplex
+
+import (
+	"iter"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type greeting struct {
+	Name    string `json:"name"`
+	Shout   bool   `json:"shout,omitempty"`
+	private int
+}
+
+func TestRemoteMethods(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("greet", Echo,
+		MethodDoc("Greets someone."),
+		MethodArgs(greeting{}),
+		MethodReply(""),
+		MethodIdempotent())
+	rpc.Register("hidden", Echo)
+	RegisterStream(rpc, "count", func(args interface{}, ch *Channel) (iter.Seq[int], error) {
+		return slices.Values([]int{1, 2, 3}), nil
+	})
+	sub := NewRPC(rpc.codec)
+	sub.Register("read", Echo)
+	rpc.Mount("files", sub)
+	server, client := NewPeerPair(rpc)
+	server.Register("hidden", Echo, MethodDoc("Peer only."))
+
+	methods, err := client.RemoteMethods(context.Background())
+	Fatal(err, t)
+	var names []string
+	byName := make(map[string]MethodInfo)
+	for _, info := range methods {
+		names = append(names, info.Name)
+		byName[info.Name] = info
+	}
+	expected := []string{"count", "duplex.describe", "duplex.identity",
+		"duplex.methods", "files.read", "greet", "hidden"}
+	if !slices.Equal(names, expected) {
+		t.Fatal("Unexpected methods:", names)
+	}
+	greet := byName["greet"]
+	if greet.Doc != "Greets someone." || !greet.Idempotent || greet.Reply["type"] != "string" {
+		t.Fatal("Unexpected greet info:", greet)
+	}
+	properties := greet.Args["properties"].(map[string]interface{})
+	if len(properties) != 2 || properties["name"].(map[string]interface{})["type"] != "string" {
+		t.Fatal("Unexpected args schema:", greet.Args)
+	}
+	if !byName["count"].StreamReply {
+		t.Fatal("Stream not marked as streaming:", byName["count"])
+	}
+	if byName["hidden"].Doc != "Peer only." {
+		t.Fatal("Peer method didn't hide RPC method:", byName["hidden"])
+	}
+}
+
+func TestDescribeAndIdentity(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetIdentity(map[string]string{"name": "test", "version": "1.0"})
+	rpc.Register("echo", Echo, MethodDoc("Echoes its argument."))
+	_, client := NewPeerPair(rpc)
+	var info MethodInfo
+	Fatal(client.Call("duplex.describe", "echo", &info), t)
+	if info.Name != "echo" || info.Doc != "Echoes its argument." {
+		t.Fatal("Unexpected description:", info)
+	}
+	err := client.Call("duplex.describe", "missing", &info)
+	if rpcError, ok := err.(*Error); !ok || rpcError.Code != ErrCodeMethodNotFound {
+		t.Fatal("Expected method not found, got:", err)
+	}
+	var identity map[string]interface{}
+	Fatal(client.Call("duplex.identity", nil, &identity), t)
+	if identity["name"] != "test" || identity["version"] != "1.0" {
+		t.Fatal("Unexpected identity:", identity)
+	}
+}
+
+func TestCallContextDeadline(t *testing.T) {
+	rpc := NewTestRPC()
+	release := make(chan bool)
+	rpc.Register("slow", func(ch *Channel) error {
+		<-release
+		return Echo(ch)
+	})
+	_, client := NewPeerPair(rpc)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := client.CallContext(ctx, "slow", 1, new(float64))
+	if err != context.DeadlineExceeded {
+		t.Fatal("Expected deadline exceeded, got:", err)
+	}
+	close(release)
+	var reply float64
+	Fatal(client.Call("slow", 2, &reply), t)
+	if reply != 2 {
+		t.Fatal("Unexpected reply:", reply)
+	}
+}
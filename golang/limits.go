@@ -0,0 +1,208 @@
+package duplex
+
+import (
+	"sync"
+)
+
+/*
+Handler limits
+
+By default every inbound request runs its handler in a new
+goroutine. Limits bound how many handlers run at once, per RPC
+across all its peers and per Peer. Requests over the limit wait
+in a queue that holds no goroutines; once the queue is full they
+are rejected with ErrCodeBusy.
+*/
+
+// limiter hands out a fixed number of slots, queueing tasks
+// until one frees up.
+type limiter struct {
+	sync.Mutex
+	max     int // running tasks, unlimited when <= 0
+	queue   int // waiting tasks, unbounded when 0, none when < 0
+	running int
+	waiting []func(done func())
+}
+
+func (l *limiter) set(max, queue int) {
+	l.Lock()
+	defer l.Unlock()
+	l.max, l.queue = max, queue
+}
+
+// run calls task with a slot, now or once one is released, or
+// calls reject if the queue is full. task must call done when
+// it's finished with the slot.
+func (l *limiter) run(task func(done func()), reject func()) {
+	l.Lock()
+	if l.max <= 0 || l.running < l.max {
+		l.running++
+		l.Unlock()
+		task(l.release)
+		return
+	}
+	if l.queue < 0 || (l.queue > 0 && len(l.waiting) >= l.queue) {
+		l.Unlock()
+		reject()
+		return
+	}
+	l.waiting = append(l.waiting, task)
+	l.Unlock()
+}
+
+// release hands the slot to the next waiting task, if any.
+func (l *limiter) release() {
+	l.Lock()
+	if len(l.waiting) == 0 || (l.max > 0 && l.running > l.max) {
+		l.running--
+		l.Unlock()
+		return
+	}
+	next := l.waiting[0]
+	l.waiting = l.waiting[1:]
+	l.Unlock()
+	next(l.release)
+}
+
+// pool runs tasks on a fixed set of goroutines.
+type pool struct {
+	mu      sync.Mutex // held while submitting, so retiring can close tasks
+	tasks   chan func()
+	retired bool
+}
+
+func newPool(size int) *pool {
+	// the handler limit keeps submitted but unfinished tasks
+	// within size, so submitting never blocks
+	p := &pool{tasks: make(chan func(), size)}
+	for i := 0; i < size; i++ {
+		go func() {
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a task, reporting false if the pool was retired.
+func (p *pool) submit(task func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.retired {
+		return false
+	}
+	p.tasks <- task
+	return true
+}
+
+// retire stops the pool taking tasks. Its workers exit once they
+// have run the tasks already submitted.
+func (p *pool) retire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retired = true
+	close(p.tasks)
+}
+
+// SetHandlerLimit bounds the handlers running at once across all
+// peers of this RPC. Up to queue further requests wait for a free
+// slot; zero queues without bound and a negative queue rejects
+// requests as soon as the limit is reached. A max of zero
+// removes the limit.
+func (rpc *RPC) SetHandlerLimit(max, queue int) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.handlerMax, rpc.handlerQueue = max, queue
+	rpc.applyHandlerLimit()
+}
+
+// SetPeerHandlerLimit sets the default handler limit for each
+// peer created after the call. See Peer.SetHandlerLimit.
+func (rpc *RPC) SetPeerHandlerLimit(max, queue int) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.peerMax, rpc.peerQueue = max, queue
+}
+
+// SetWorkers runs handlers on a fixed pool of size goroutines
+// instead of one goroutine per request, which also caps the
+// handler limit at size. Handlers already running on a previous
+// pool finish there.
+func (rpc *RPC) SetWorkers(size int) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	if rpc.pool != nil {
+		rpc.pool.retire()
+		rpc.pool = nil
+	}
+	if size > 0 {
+		rpc.pool = newPool(size)
+	}
+	rpc.workers = size
+	rpc.applyHandlerLimit()
+}
+
+func (rpc *RPC) applyHandlerLimit() {
+	max := rpc.handlerMax
+	if rpc.workers > 0 && (max <= 0 || max > rpc.workers) {
+		max = rpc.workers
+	}
+	rpc.handlers.set(max, rpc.handlerQueue)
+}
+
+func (rpc *RPC) spawn(task func()) {
+	for {
+		rpc.Lock()
+		p := rpc.pool
+		rpc.Unlock()
+		if p == nil {
+			go task()
+			return
+		}
+		if p.submit(task) {
+			return
+		}
+		// the pool was replaced meanwhile
+	}
+}
+
+// SetHandlerLimit bounds the handlers running at once for this
+// peer, in addition to any limit on its RPC. The queue behaves
+// as in RPC.SetHandlerLimit.
+func (peer *Peer) SetHandlerLimit(max, queue int) {
+	peer.handlers.set(max, queue)
+}
+
+// dispatch starts a handler once both the peer and the RPC have
+// a free slot for it.
+func (peer *Peer) dispatch(fn func(*Channel) error, ch *Channel) {
+	peer.handlers.run(func(peerDone func()) {
+		peer.rpc.handlers.run(func(rpcDone func()) {
+			peer.rpc.spawn(func() {
+				peer.handle(fn, ch)
+				rpcDone()
+				peerDone()
+			})
+		}, func() {
+			peerDone()
+			peer.reject(ch)
+		})
+	}, func() {
+		peer.reject(ch)
+	})
+}
+
+// reject answers a request that couldn't be queued.
+func (peer *Peer) reject(ch *Channel) {
+	peer.log().Warn("handler limit reached",
+		"method", ch.method, "id", ch.id)
+	ch.mu.Lock()
+	ch.handled = true
+	ch.mu.Unlock()
+	if ch.id != 0 {
+		ch.SendErr(ErrCodeBusy, "busy", nil)
+	}
+	peer.release(ch)
+	peer.handlerDone()
+}
@@ -0,0 +1,123 @@
+package duplex
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrencyProbe records the most handlers seen running at once.
+type concurrencyProbe struct {
+	running atomic.Int32
+	peak    atomic.Int32
+}
+
+func (p *concurrencyProbe) Handler(ch *Channel) error {
+	n := p.running.Add(1)
+	for {
+		peak := p.peak.Load()
+		if n <= peak || p.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	p.running.Add(-1)
+	return Echo(ch)
+}
+
+func callConcurrently(t *testing.T, peer *Peer, method string, n int) []error {
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply float64
+			errs[i] = peer.Call(method, i, &reply)
+			if errs[i] == nil && reply != float64(i) {
+				t.Error("Unexpected reply:", reply)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestHandlerLimitQueues(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetHandlerLimit(2, 0)
+	probe := &concurrencyProbe{}
+	rpc.Register("probe", probe.Handler)
+	client, _ := NewPeerPair(rpc)
+	for _, err := range callConcurrently(t, client, "probe", 10) {
+		Fatal(err, t)
+	}
+	if peak := probe.peak.Load(); peak > 2 {
+		t.Fatal("Too many concurrent handlers:", peak)
+	}
+}
+
+func TestPeerHandlerLimitRejectsBusy(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetPeerHandlerLimit(1, -1)
+	started := make(chan bool)
+	release := make(chan bool)
+	rpc.Register("block", func(ch *Channel) error {
+		started <- true
+		<-release
+		return Echo(ch)
+	})
+	client, _ := NewPeerPair(rpc)
+	done := make(chan error)
+	go func() {
+		done <- client.Call("block", 1, new(float64))
+	}()
+	<-started
+	err := client.Call("block", 2, new(float64))
+	rpcError, ok := err.(*Error)
+	if !ok || rpcError.Code != ErrCodeBusy {
+		t.Fatal("Expected busy error, got:", err)
+	}
+	close(release)
+	Fatal(<-done, t)
+}
+
+func TestWorkerPool(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetWorkers(3)
+	probe := &concurrencyProbe{}
+	rpc.Register("probe", probe.Handler)
+	client, _ := NewPeerPair(rpc)
+	for _, err := range callConcurrently(t, client, "probe", 20) {
+		Fatal(err, t)
+	}
+	if peak := probe.peak.Load(); peak > 3 {
+		t.Fatal("Too many concurrent handlers:", peak)
+	}
+}
+
+func TestSetWorkersWhileConnected(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetWorkers(2)
+	rpc.Register("echo", Echo)
+	client, _ := NewPeerPair(rpc)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for _, err := range callConcurrently(t, client, "echo", 200) {
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			return
+		default:
+			rpc.SetWorkers(1 + i%4)
+		}
+	}
+}
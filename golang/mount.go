@@ -0,0 +1,101 @@
+package duplex
+
+import (
+	"strings"
+)
+
+/*
+Routing
+
+An RPC resolves a method to a handler by looking, in order, at
+its registered methods, at the RPC mounted under the longest
+dotted prefix of the method name, and at its default handler.
+A mounted RPC resolves the rest of the name the same way:
+
+	rpc.Mount("files", files)        // "files.read" -> files "read"
+	files.Mount("admin", admin)      // "files.admin.purge" -> admin "purge"
+
+Each RPC wraps the handlers it resolves, including those found
+in its mounts, in its own middleware, so a mount's middleware
+runs inside that of the RPC it's mounted on.
+*/
+
+// Middleware wraps the handler for a method. The method name is
+// relative to the RPC the middleware was added to.
+type Middleware func(method string, next func(*Channel) error) func(*Channel) error
+
+// Use adds middleware around every handler resolved by this RPC.
+// The first middleware added is the outermost.
+func (rpc *RPC) Use(middleware ...Middleware) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.middleware = append(rpc.middleware, middleware...)
+}
+
+// Mount routes methods named prefix.method to method on sub. A nil
+// sub removes the mount.
+func (rpc *RPC) Mount(prefix string, sub *RPC) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	if sub == nil {
+		delete(rpc.mounts, prefix)
+		return
+	}
+	rpc.mounts[prefix] = sub
+}
+
+// RegisterDefault sets a handler for methods that resolve to no
+// other handler, instead of answering them with method not found.
+// It can use Channel.Method to see the method called.
+func (rpc *RPC) RegisterDefault(handler func(*Channel) error) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.fallback = handler
+}
+
+// handler resolves method to a handler wrapped in middleware, or
+// returns nil if nothing handles it.
+func (rpc *RPC) handler(method string) func(*Channel) error {
+	rpc.Lock()
+	fn := rpc.registered[method]
+	fallback := rpc.fallback
+	sub, rest := rpc.mount(method)
+	rpc.Unlock()
+	if fn == nil && sub != nil {
+		fn = sub.handler(rest)
+	}
+	if fn == nil {
+		fn = fallback
+	}
+	if fn == nil {
+		return nil
+	}
+	return rpc.wrap(method, fn)
+}
+
+// mount finds the RPC mounted under the longest prefix of method
+// and the rest of the name. rpc must be locked.
+func (rpc *RPC) mount(method string) (*RPC, string) {
+	for i := strings.LastIndex(method, "."); i > 0; i = strings.LastIndex(method[:i], ".") {
+		if sub, ok := rpc.mounts[method[:i]]; ok {
+			return sub, method[i+1:]
+		}
+	}
+	return nil, ""
+}
+
+// wrap applies the RPC's middleware to fn.
+func (rpc *RPC) wrap(method string, fn func(*Channel) error) func(*Channel) error {
+	rpc.Lock()
+	middleware := rpc.middleware
+	rpc.Unlock()
+	for i := len(middleware) - 1; i >= 0; i-- {
+		fn = middleware[i](method, fn)
+	}
+	return fn
+}
+
+// Method returns the name of the method the channel was opened for.
+func (ch *Channel) Method() string {
+	return ch.method
+}
@@ -0,0 +1,103 @@
+package duplex
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestMount(t *testing.T) {
+	rpc := NewTestRPC()
+	files := NewRPC(rpc.codec)
+	admin := NewRPC(rpc.codec)
+	files.Register("read", func(ch *Channel) error {
+		return ch.Send("files:"+ch.Method(), false)
+	})
+	admin.Register("purge", func(ch *Channel) error {
+		return ch.Send("admin:"+ch.Method(), false)
+	})
+	rpc.Mount("files", files)
+	files.Mount("admin", admin)
+	rpc.Mount("a.b", admin)
+	client, _ := NewPeerPair(rpc)
+	for method, expected := range map[string]string{
+		"files.read":        "files:files.read",
+		"files.admin.purge": "admin:files.admin.purge",
+		"a.b.purge":         "admin:a.b.purge",
+	} {
+		var reply string
+		Fatal(client.Call(method, nil, &reply), t)
+		if reply != expected {
+			t.Fatal("Unexpected reply:", reply)
+		}
+	}
+	for _, method := range []string{"files", "files.purge", "read", "a.purge"} {
+		err := client.Call(method, nil, new(string))
+		if rpcError, ok := err.(*Error); !ok || rpcError.Code != ErrCodeMethodNotFound {
+			t.Fatal("Expected method not found for", method, "got:", err)
+		}
+	}
+	rpc.Mount("files", nil)
+	err := client.Call("files.read", nil, new(string))
+	if rpcError, ok := err.(*Error); !ok || rpcError.Code != ErrCodeMethodNotFound {
+		t.Fatal("Expected method not found after unmount, got:", err)
+	}
+}
+
+func TestMiddlewareChains(t *testing.T) {
+	var mu sync.Mutex
+	var trace []string
+	tracer := func(name string) Middleware {
+		return func(method string, next func(*Channel) error) func(*Channel) error {
+			return func(ch *Channel) error {
+				mu.Lock()
+				trace = append(trace, name+":"+method)
+				mu.Unlock()
+				return next(ch)
+			}
+		}
+	}
+	rpc := NewTestRPC()
+	sub := NewRPC(rpc.codec)
+	rpc.Use(tracer("outer"), tracer("inner"))
+	sub.Use(tracer("sub"))
+	sub.Register("echo", Echo)
+	rpc.Mount("sub", sub)
+	server, client := NewPeerPair(rpc)
+	server.Register("session", Echo)
+	Fatal(client.Call("sub.echo", 1, new(float64)), t)
+	Fatal(client.Call("session", 1, new(float64)), t)
+	expected := []string{
+		"outer:sub.echo", "inner:sub.echo", "sub:echo",
+		"outer:session", "inner:session",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(trace, expected) {
+		t.Fatal("Unexpected middleware trace:", trace)
+	}
+}
+
+func TestRegisterDefault(t *testing.T) {
+	rpc := NewTestRPC()
+	sub := NewRPC(rpc.codec)
+	rpc.Mount("sub", sub)
+	rpc.RegisterDefault(func(ch *Channel) error {
+		return ch.Send("default:"+ch.Method(), false)
+	})
+	rpc.Register("echo", Echo)
+	client, _ := NewPeerPair(rpc)
+	var reply string
+	Fatal(client.Call("missing", nil, &reply), t)
+	if reply != "default:missing" {
+		t.Fatal("Unexpected reply:", reply)
+	}
+	Fatal(client.Call("sub.missing", nil, &reply), t)
+	if reply != "default:sub.missing" {
+		t.Fatal("Unexpected reply:", reply)
+	}
+	Fatal(client.Call("echo", "hi", &reply), t)
+	if reply != "hi" {
+		t.Fatal("Default handler shadowed a method:", reply)
+	}
+}
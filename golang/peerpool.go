@@ -0,0 +1,273 @@
+package duplex
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+/*
+Peer pools
+
+A pool spreads calls over several peers offering the same
+methods, like workers connected to a coordinator. Peers leave
+the pool when they close, and peers whose remote is shutting
+down get no new calls.
+
+A call that fails without reaching a handler, because the peer
+closed, refused it as busy, shutting down or rate limited, or its
+circuit is open, is retried on another peer. Calls that reach a
+handler and fail aren't. A call cut off by its peer closing may
+have run, so methods called through a pool should be safe to
+repeat.
+*/
+
+var ErrNoPeers = errors.New("duplex: no peers available")
+
+// Strategy chooses how a PeerPool spreads calls.
+type Strategy int
+
+const (
+	// RoundRobin takes the peers in turn.
+	RoundRobin Strategy = iota
+	// LeastInFlight takes the peer with the fewest calls running.
+	LeastInFlight
+	// ConsistentHash takes the peer owning the call's key on a
+	// hash ring, so a key keeps going to the same peer while it's
+	// in the pool.
+	ConsistentHash
+)
+
+// HashReplicas is the number of points each peer has on the hash
+// ring of a ConsistentHash pool.
+var HashReplicas = 64
+
+type pooledPeer struct {
+	peer     *Peer
+	inflight atomic.Int64
+}
+
+type ringPoint struct {
+	hash   uint32
+	member *pooledPeer
+}
+
+// PeerPool balances calls across a set of peers.
+type PeerPool struct {
+	strategy Strategy
+
+	mu      sync.Mutex
+	members []*pooledPeer
+	ring    []ringPoint // sorted by hash
+	next    int
+
+	callMiddleware []CallMiddleware
+}
+
+func NewPeerPool(strategy Strategy) *PeerPool {
+	return &PeerPool{strategy: strategy}
+}
+
+// Add puts peer in the pool until it closes or is removed.
+func (pool *PeerPool) Add(peer *Peer) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, m := range pool.members {
+		if m.peer == peer {
+			return
+		}
+	}
+	pool.members = append(pool.members, &pooledPeer{peer: peer})
+	pool.buildRing()
+	go func() {
+		<-peer.Done()
+		pool.Remove(peer)
+	}()
+}
+
+// Remove takes peer out of the pool. Calls already made on it
+// are unaffected.
+func (pool *PeerPool) Remove(peer *Peer) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for i, m := range pool.members {
+		if m.peer == peer {
+			pool.members = append(pool.members[:i:i], pool.members[i+1:]...)
+			pool.buildRing()
+			return
+		}
+	}
+}
+
+// Peers returns the peers in the pool.
+func (pool *PeerPool) Peers() []*Peer {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	peers := make([]*Peer, len(pool.members))
+	for i, m := range pool.members {
+		peers[i] = m.peer
+	}
+	return peers
+}
+
+// buildRing places the members on the hash ring. mu must be held.
+func (pool *PeerPool) buildRing() {
+	if pool.strategy != ConsistentHash {
+		return
+	}
+	pool.ring = pool.ring[:0]
+	for _, m := range pool.members {
+		for i := 0; i < HashReplicas; i++ {
+			point := hashKey(fmt.Sprintf("%p-%d", m.peer, i))
+			pool.ring = append(pool.ring, ringPoint{point, m})
+		}
+	}
+	sort.Slice(pool.ring, func(i, j int) bool {
+		return pool.ring[i].hash < pool.ring[j].hash
+	})
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// healthy reports whether a peer can take new calls.
+func healthy(peer *Peer) bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return peer.closeErr == nil && !peer.goingAway
+}
+
+// pick chooses a healthy member not in tried, or returns nil.
+func (pool *PeerPool) pick(key string, tried map[*pooledPeer]bool) *pooledPeer {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	usable := func(m *pooledPeer) bool {
+		return !tried[m] && healthy(m.peer)
+	}
+	switch pool.strategy {
+	case LeastInFlight:
+		var best *pooledPeer
+		for _, m := range pool.members {
+			if usable(m) && (best == nil || m.inflight.Load() < best.inflight.Load()) {
+				best = m
+			}
+		}
+		return best
+	case ConsistentHash:
+		if len(pool.ring) == 0 {
+			return nil
+		}
+		hash := hashKey(key)
+		start := sort.Search(len(pool.ring), func(i int) bool {
+			return pool.ring[i].hash >= hash
+		})
+		for i := range pool.ring {
+			if m := pool.ring[(start+i)%len(pool.ring)].member; usable(m) {
+				return m
+			}
+		}
+		return nil
+	}
+	for range pool.members {
+		m := pool.members[pool.next%len(pool.members)]
+		pool.next++
+		if usable(m) {
+			return m
+		}
+	}
+	return nil
+}
+
+// retryable reports whether a call failed without reaching a
+// handler, so it can be made on another peer.
+func retryable(err error) bool {
+	var rpcError *Error
+	if errors.As(err, &rpcError) {
+		switch rpcError.Code {
+		case ErrCodeBusy, ErrCodeShuttingDown, ErrCodeCircuitOpen, ErrCodeRateLimited:
+			return true
+		}
+		return false
+	}
+	return errors.Is(err, ErrPeerClosed)
+}
+
+// Call calls method on a peer from the pool. With ConsistentHash
+// the method name is the key.
+func (pool *PeerPool) Call(method string, args interface{}, reply interface{}) error {
+	return pool.CallKey(context.Background(), method, method, args, reply)
+}
+
+// CallContext is like Call but gives up when ctx is done.
+func (pool *PeerPool) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	return pool.CallKey(ctx, method, method, args, reply)
+}
+
+// CallKey calls method on a peer from the pool, choosing by key
+// with ConsistentHash. Each peer is tried at most once.
+func (pool *PeerPool) CallKey(ctx context.Context, key, method string, args interface{}, reply interface{}) error {
+	pool.mu.Lock()
+	middleware := pool.callMiddleware
+	pool.mu.Unlock()
+	return chain(func(ctx context.Context, method string, args interface{}, reply interface{}) error {
+		return pool.call(ctx, key, method, args, reply)
+	}, middleware)(ctx, method, args, reply)
+}
+
+func (pool *PeerPool) call(ctx context.Context, key, method string, args interface{}, reply interface{}) error {
+	tried := make(map[*pooledPeer]bool)
+	err := ErrNoPeers
+	for {
+		m := pool.pick(key, tried)
+		if m == nil {
+			return err
+		}
+		tried[m] = true
+		m.inflight.Add(1)
+		err = m.peer.CallContext(ctx, method, args, reply)
+		m.inflight.Add(-1)
+		if err == nil || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		m.peer.log().Warn("retrying call on another peer",
+			"method", method, "err", err)
+	}
+}
+
+// Open opens a channel to method on a peer from the pool. With
+// ConsistentHash the method name is the key. Streams aren't
+// retried, since their messages can't be replayed.
+func (pool *PeerPool) Open(method string) (*Channel, error) {
+	return pool.OpenKey(method, method)
+}
+
+// OpenKey is like Open, choosing the peer by key.
+func (pool *PeerPool) OpenKey(key, method string) (*Channel, error) {
+	m := pool.pick(key, nil)
+	if m == nil {
+		return nil, ErrNoPeers
+	}
+	m.inflight.Add(1)
+	ch := m.peer.Open(method)
+	if ch.id == 0 {
+		// the peer closed since it was picked
+		m.inflight.Add(-1)
+		return nil, ch.err
+	}
+	go func() {
+		// count the stream until it ends, leaving its done
+		// signal in place for the caller
+		<-ch.done
+		ch.done <- ch
+		m.inflight.Add(-1)
+	}()
+	return ch, nil
+}
@@ -0,0 +1,134 @@
+package duplex
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// poolWorkers connects n workers to a coordinator, each answering
+// "whoami" with its index, and returns a pool of them.
+func poolWorkers(t *testing.T, strategy Strategy, n int) (*PeerPool, []*Peer) {
+	pool := NewPeerPool(strategy)
+	var workers []*Peer
+	for i := 0; i < n; i++ {
+		rpc := NewTestRPC()
+		i := i
+		rpc.Register("whoami", func(ch *Channel) error {
+			if _, err := ch.Recv(new(interface{})); err != nil {
+				return err
+			}
+			return ch.Send(i, false)
+		})
+		coordinator, worker := NewPeerPair(rpc)
+		pool.Add(coordinator)
+		workers = append(workers, worker)
+	}
+	return pool, workers
+}
+
+func TestPeerPoolRoundRobin(t *testing.T) {
+	pool, _ := poolWorkers(t, RoundRobin, 3)
+	var seen []float64
+	for i := 0; i < 6; i++ {
+		var reply float64
+		Fatal(pool.Call("whoami", nil, &reply), t)
+		seen = append(seen, reply)
+	}
+	for i := 0; i < 3; i++ {
+		if seen[i] != seen[i+3] || seen[i] == seen[(i+1)%3] {
+			t.Fatal("Calls not spread in turn:", seen)
+		}
+	}
+}
+
+func TestPeerPoolConsistentHash(t *testing.T) {
+	pool, _ := poolWorkers(t, ConsistentHash, 4)
+	owners := make(map[string]float64)
+	spread := make(map[float64]bool)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprint("key", i)
+		var reply float64
+		Fatal(pool.CallKey(context.Background(), key, "whoami", nil, &reply), t)
+		owners[key] = reply
+		spread[reply] = true
+	}
+	if len(spread) < 2 {
+		t.Fatal("Keys not spread over peers:", spread)
+	}
+	for key, owner := range owners {
+		var reply float64
+		Fatal(pool.CallKey(context.Background(), key, "whoami", nil, &reply), t)
+		if reply != owner {
+			t.Fatal("Key moved between peers:", key)
+		}
+	}
+}
+
+func TestPeerPoolLeastInFlight(t *testing.T) {
+	pool := NewPeerPool(LeastInFlight)
+	release := make(chan bool)
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	for _, name := range []string{"a", "b"} {
+		rpc := NewTestRPC()
+		name := name
+		rpc.Register("work", func(ch *Channel) error {
+			mu.Lock()
+			calls[name]++
+			mu.Unlock()
+			<-release
+			return Echo(ch)
+		})
+		coordinator, _ := NewPeerPair(rpc)
+		pool.Add(coordinator)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.Call("work", 1, new(float64))
+		}()
+	}
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls["a"]+calls["b"] == 4
+	})
+	close(release)
+	wg.Wait()
+	if calls["a"] != 2 || calls["b"] != 2 {
+		t.Fatal("Calls not balanced by load:", calls)
+	}
+}
+
+func TestPeerPoolRemovesClosedAndRetries(t *testing.T) {
+	pool, workers := poolWorkers(t, RoundRobin, 2)
+	peers := pool.Peers()
+	// the first worker refuses calls, so they go to the second
+	workers[0].mu.Lock()
+	workers[0].draining = true
+	workers[0].mu.Unlock()
+	for i := 0; i < 3; i++ {
+		var reply float64
+		Fatal(pool.Call("whoami", nil, &reply), t)
+		if reply != 1 {
+			t.Fatal("Call not retried on another peer:", reply)
+		}
+	}
+
+	peers[1].Close()
+	waitFor(t, func() bool {
+		return len(pool.Peers()) == 1
+	})
+	peers[0].Close()
+	waitFor(t, func() bool {
+		return len(pool.Peers()) == 0
+	})
+	if err := pool.Call("whoami", nil, new(float64)); err != ErrNoPeers {
+		t.Fatal("Expected no peers, got:", err)
+	}
+}
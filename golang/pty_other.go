@@ -0,0 +1,20 @@
+//go:build !linux
+
+package duplex
+
+import (
+	"os"
+	"os/exec"
+)
+
+func startPty(cmd *exec.Cmd, size *WindowSize) (*os.File, error) {
+	return nil, ErrPtyUnsupported
+}
+
+func setWinsize(tty *os.File, size WindowSize) error {
+	return ErrPtyUnsupported
+}
+
+func notifyResize(fn func()) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,254 @@
+package duplex
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+Rate limiting
+
+RateLimiter is middleware that refuses requests arriving faster
+than their limits allow, so one noisy client can't take over the
+handlers. Limits are token buckets: a bucket holds up to Burst
+tokens, refills at Rate tokens a second, and each request takes
+one from every bucket that applies to it:
+
+	per peer      one bucket for each connected peer
+	per identity  one bucket shared by the peers with an identity
+	per method    one bucket for each peer calling the method
+
+A refused request is answered with ErrCodeRateLimited, whose data
+holds the milliseconds until it would be allowed as "retryAfter":
+
+	{"type": "rep", "id": 4, "error": {"code": -32004,
+		"message": "rate limited", "data": {"retryAfter": 250}}}
+
+	limits := duplex.NewRateLimiter()
+	limits.PerPeer(duplex.RateLimit{Rate: 50, Burst: 100})
+	limits.PerMethod("search", duplex.RateLimit{Rate: 1, Burst: 5})
+	rpc.Use(limits.Middleware)
+*/
+
+// ErrCodeRateLimited is returned for requests over a rate limit.
+const ErrCodeRateLimited = -32004
+
+// RateLimit is a token bucket allowing Rate requests a second on
+// average and up to Burst at once. A zero Rate is no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit RateLimit, now time.Time) *bucket {
+	return &bucket{limit: limit, tokens: limit.burst(), last: now}
+}
+
+func (limit RateLimit) burst() float64 {
+	if limit.Burst < 1 {
+		return 1
+	}
+	return float64(limit.Burst)
+}
+
+// refill adds the tokens earned since the last refill and returns
+// how long until a token is available.
+func (b *bucket) refill(now time.Time) time.Duration {
+	b.tokens = math.Min(b.limit.burst(), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+type methodBucketKey struct {
+	peer   *Peer
+	method string
+}
+
+// RateLimiter applies rate limits to the requests of an RPC.
+type RateLimiter struct {
+	mu       sync.Mutex
+	peer     RateLimit
+	peers    map[*Peer]RateLimit // limits overriding peer
+	identity RateLimit
+	identify func(*Channel) interface{}
+	methods  map[string]RateLimit
+
+	peerBuckets     map[*Peer]*bucket
+	identityBuckets map[interface{}]*bucket
+	methodBuckets   map[methodBucketKey]*bucket
+	watched         map[*Peer]bool // peers watched for closing
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		peers:           make(map[*Peer]RateLimit),
+		methods:         make(map[string]RateLimit),
+		peerBuckets:     make(map[*Peer]*bucket),
+		identityBuckets: make(map[interface{}]*bucket),
+		methodBuckets:   make(map[methodBucketKey]*bucket),
+		watched:         make(map[*Peer]bool),
+	}
+}
+
+// PerPeer limits the requests of each peer.
+func (l *RateLimiter) PerPeer(limit RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peer = limit
+	l.reset()
+}
+
+// SetPeerLimit gives peer its own limit in place of the one set by
+// PerPeer.
+func (l *RateLimiter) SetPeerLimit(peer *Peer, limit RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peers[peer] = limit
+	delete(l.peerBuckets, peer)
+	l.watch(peer)
+}
+
+// PerIdentity limits the requests of all peers sharing an identity,
+// such as an authenticated user. identify returns the identity
+// behind a request, usually from its Context, or nil to skip the
+// limit.
+func (l *RateLimiter) PerIdentity(limit RateLimit, identify func(*Channel) interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.identity, l.identify = limit, identify
+	l.reset()
+}
+
+// PerMethod limits the requests each peer makes to method.
+func (l *RateLimiter) PerMethod(method string, limit RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.methods[method] = limit
+	l.reset()
+}
+
+// reset drops the buckets so new limits apply. mu must be held.
+func (l *RateLimiter) reset() {
+	clear(l.peerBuckets)
+	clear(l.identityBuckets)
+	clear(l.methodBuckets)
+}
+
+// Middleware is the Middleware applying the limits.
+func (l *RateLimiter) Middleware(method string, next func(*Channel) error) func(*Channel) error {
+	return func(ch *Channel) error {
+		wait := l.take(method, ch)
+		if wait == 0 {
+			return next(ch)
+		}
+		ch.Peer.log().Warn("rate limited",
+			"method", ch.method, "id", ch.id, "retryAfter", wait)
+		if ch.id == 0 {
+			return nil
+		}
+		return ch.SendErr(ErrCodeRateLimited, "rate limited",
+			map[string]interface{}{"retryAfter": ceilMilliseconds(wait)})
+	}
+}
+
+// take spends a token from each bucket applying to a request, or
+// none if any is empty, returning how long until all have one.
+func (l *RateLimiter) take(method string, ch *Channel) time.Duration {
+	l.mu.Lock()
+	identify := l.identify
+	l.mu.Unlock()
+	var identity interface{}
+	if identify != nil && l.identity.Rate > 0 {
+		identity = identify(ch)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var buckets []*bucket
+	limit, ok := l.peers[ch.Peer]
+	if !ok {
+		limit = l.peer
+	}
+	if limit.Rate > 0 {
+		b := l.peerBuckets[ch.Peer]
+		if b == nil {
+			b = newBucket(limit, now)
+			l.peerBuckets[ch.Peer] = b
+			l.watch(ch.Peer)
+		}
+		buckets = append(buckets, b)
+	}
+	if identity != nil {
+		b := l.identityBuckets[identity]
+		if b == nil {
+			b = newBucket(l.identity, now)
+			l.identityBuckets[identity] = b
+		}
+		buckets = append(buckets, b)
+	}
+	if limit := l.methods[method]; limit.Rate > 0 {
+		key := methodBucketKey{ch.Peer, method}
+		b := l.methodBuckets[key]
+		if b == nil {
+			b = newBucket(limit, now)
+			l.methodBuckets[key] = b
+			l.watch(ch.Peer)
+		}
+		buckets = append(buckets, b)
+	}
+	var wait time.Duration
+	for _, b := range buckets {
+		wait = max(wait, b.refill(now))
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0
+}
+
+// watch arranges to drop a peer's buckets once it closes. mu must
+// be held.
+func (l *RateLimiter) watch(peer *Peer) {
+	if l.watched[peer] {
+		return
+	}
+	l.watched[peer] = true
+	go func() {
+		<-peer.Done()
+		l.forget(peer)
+	}()
+}
+
+func (l *RateLimiter) forget(peer *Peer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.peers, peer)
+	delete(l.peerBuckets, peer)
+	for key := range l.methodBuckets {
+		if key.peer == peer {
+			delete(l.methodBuckets, key)
+		}
+	}
+	// identities outlive peers, but a full bucket is as good as none
+	now := time.Now()
+	for identity, b := range l.identityBuckets {
+		if b.refill(now); b.tokens >= b.limit.burst() {
+			delete(l.identityBuckets, identity)
+		}
+	}
+	delete(l.watched, peer)
+}
@@ -0,0 +1,85 @@
+package duplex
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitPerPeer(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("echo", Echo)
+	limits := NewRateLimiter()
+	limits.PerPeer(RateLimit{Rate: 5, Burst: 2})
+	rpc.Use(limits.Middleware)
+	_, client1 := NewPeerPair(rpc)
+	_, client2 := NewPeerPair(rpc)
+
+	// calls drain the burst faster than it refills, however long
+	// each takes
+	var err error
+	for i := 0; i < 10 && errorCode(err) != ErrCodeRateLimited; i++ {
+		err = client1.Call("echo", "ok", new(string))
+	}
+	rpcError, ok := err.(*Error)
+	if !ok || rpcError.Code != ErrCodeRateLimited {
+		t.Fatal("Expected rate limited error, got:", err)
+	}
+	retryAfter, ok := rpcError.Data.(map[string]interface{})["retryAfter"].(float64)
+	if !ok || retryAfter <= 0 || retryAfter > 200 {
+		t.Fatal("Unexpected retryAfter:", rpcError.Data)
+	}
+	Fatal(client2.Call("echo", "ok", new(string)), t)
+
+	time.Sleep(time.Duration(retryAfter)*time.Millisecond + 10*time.Millisecond)
+	Fatal(client1.Call("echo", "ok", new(string)), t)
+}
+
+func TestRateLimitPeerOverride(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("echo", Echo)
+	limits := NewRateLimiter()
+	limits.PerPeer(RateLimit{Rate: 1, Burst: 1})
+	rpc.Use(limits.Middleware)
+	server, client := NewPeerPair(rpc)
+	limits.SetPeerLimit(server, RateLimit{Rate: 1, Burst: 3})
+	for i := 0; i < 3; i++ {
+		Fatal(client.Call("echo", "ok", new(string)), t)
+	}
+	if err := client.Call("echo", "ok", new(string)); errorCode(err) != ErrCodeRateLimited {
+		t.Fatal("Expected rate limited error, got:", err)
+	}
+}
+
+func TestRateLimitPerIdentity(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("echo", Echo)
+	limits := NewRateLimiter()
+	limits.PerIdentity(RateLimit{Rate: 1, Burst: 2}, func(ch *Channel) interface{} {
+		return "alice"
+	})
+	rpc.Use(limits.Middleware)
+	_, client1 := NewPeerPair(rpc)
+	_, client2 := NewPeerPair(rpc)
+	Fatal(client1.Call("echo", "ok", new(string)), t)
+	Fatal(client2.Call("echo", "ok", new(string)), t)
+	if err := client2.Call("echo", "ok", new(string)); errorCode(err) != ErrCodeRateLimited {
+		t.Fatal("Expected shared identity limit, got:", err)
+	}
+}
+
+func TestRateLimitPerMethod(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("echo", Echo)
+	rpc.Register("search", Echo)
+	limits := NewRateLimiter()
+	limits.PerMethod("search", RateLimit{Rate: 1, Burst: 1})
+	rpc.Use(limits.Middleware)
+	_, client := NewPeerPair(rpc)
+	Fatal(client.Call("search", "ok", new(string)), t)
+	if err := client.Call("search", "ok", new(string)); errorCode(err) != ErrCodeRateLimited {
+		t.Fatal("Expected rate limited error, got:", err)
+	}
+	for i := 0; i < 5; i++ {
+		Fatal(client.Call("echo", "ok", new(string)), t)
+	}
+}
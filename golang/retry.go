@@ -0,0 +1,157 @@
+package duplex
+
+import (
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+/*
+Retries
+
+Retry is call middleware that repeats failed calls to methods
+known to be idempotent. Methods are marked idempotent locally or
+learned from the remote's introspection. Only failures that are
+likely to pass are retried: the peer closing, for calls made on a
+pool that can pick another, and by default busy and shutting down
+refusals. Waits between attempts grow
+exponentially with jitter and never outlast the call's context.
+
+	retry := duplex.NewRetry(duplex.RetryPolicy{MaxAttempts: 3})
+	retry.SetIdempotent("status")
+	pool.UseCall(retry.Middleware)
+*/
+
+// RetryPolicy configures retries of a method.
+type RetryPolicy struct {
+	// MaxAttempts is the most times a call is made, including the
+	// first. Values below 2 disable retries.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubling for each
+	// one after up to MaxBackoff. It defaults to 50ms.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Codes are the error codes worth retrying, by default
+	// ErrCodeBusy and ErrCodeShuttingDown. ErrPeerClosed is always
+	// retried on a PeerPool, and never on a single peer.
+	Codes []int
+}
+
+// Retry retries failed calls to idempotent methods.
+type Retry struct {
+	mu         sync.Mutex
+	policy     RetryPolicy
+	policies   map[string]RetryPolicy
+	idempotent map[string]bool
+}
+
+// NewRetry returns a Retry applying policy to methods without one
+// of their own.
+func NewRetry(policy RetryPolicy) *Retry {
+	return &Retry{
+		policy:     policy,
+		policies:   make(map[string]RetryPolicy),
+		idempotent: make(map[string]bool),
+	}
+}
+
+// SetPolicy sets the policy for method.
+func (r *Retry) SetPolicy(method string, policy RetryPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policies[method] = policy
+}
+
+// SetIdempotent marks methods as safe to retry.
+func (r *Retry) SetIdempotent(methods ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, method := range methods {
+		r.idempotent[method] = true
+	}
+}
+
+// Discover marks the methods the remote describes as idempotent.
+func (r *Retry) Discover(ctx context.Context, peer *Peer) error {
+	methods, err := peer.RemoteMethods(ctx)
+	if err != nil {
+		return err
+	}
+	for _, info := range methods {
+		if info.Idempotent {
+			r.SetIdempotent(info.Name)
+		}
+	}
+	return nil
+}
+
+// lookup returns the policy for method, or false if it mustn't
+// be retried.
+func (r *Retry) lookup(method string) (RetryPolicy, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	policy, ok := r.policies[method]
+	if !ok {
+		policy = r.policy
+	}
+	return policy, r.idempotent[method] && policy.MaxAttempts > 1
+}
+
+// Middleware is the CallMiddleware applying the retry policies.
+func (r *Retry) Middleware(next Invoker) Invoker {
+	return func(ctx context.Context, method string, args interface{}, reply interface{}) error {
+		policy, retry := r.lookup(method)
+		err := next(ctx, method, args, reply)
+		if !retry || reply == nil {
+			return err
+		}
+		backoff := policy.Backoff
+		if backoff <= 0 {
+			backoff = 50 * time.Millisecond
+		}
+		// a closed peer stays closed, but a pool can pick another
+		pooled := ContextPeer(ctx) == nil
+		for attempt := 1; attempt < policy.MaxAttempts && policy.retryable(err, pooled); attempt++ {
+			// wait between half and all of the backoff
+			wait := backoff/2 + rand.N(backoff/2+1)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+				return err
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+			err = next(ctx, method, args, reply)
+			backoff *= 2
+			if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+		}
+		return err
+	}
+}
+
+func (policy RetryPolicy) retryable(err error, pooled bool) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrPeerClosed) {
+		return pooled
+	}
+	var rpcError *Error
+	if !errors.As(err, &rpcError) {
+		return false
+	}
+	codes := policy.Codes
+	if codes == nil {
+		codes = []int{ErrCodeBusy, ErrCodeShuttingDown}
+	}
+	return slices.Contains(codes, rpcError.Code)
+}
@@ -0,0 +1,111 @@
+package duplex
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// flaky registers method to answer busy for the first failures
+// calls and echo after, counting the calls.
+func flaky(rpc *RPC, method string, failures int32, opts ...MethodOption) *atomic.Int32 {
+	calls := new(atomic.Int32)
+	rpc.Register(method, func(ch *Channel) error {
+		if calls.Add(1) <= failures {
+			return ch.SendErr(ErrCodeBusy, "busy", nil)
+		}
+		return Echo(ch)
+	}, opts...)
+	return calls
+}
+
+func TestRetryIdempotentMethods(t *testing.T) {
+	rpc := NewTestRPC()
+	status := flaky(rpc, "status", 2)
+	update := flaky(rpc, "update", 2)
+	retry := NewRetry(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+	retry.SetIdempotent("status")
+	rpc.UseCall(retry.Middleware)
+	_, client := NewPeerPair(rpc)
+
+	var reply string
+	Fatal(client.Call("status", "ok", &reply), t)
+	if reply != "ok" || status.Load() != 3 {
+		t.Fatal("Unexpected result:", reply, status.Load())
+	}
+	err := client.Call("update", "ok", &reply)
+	if rpcError, ok := err.(*Error); !ok || rpcError.Code != ErrCodeBusy {
+		t.Fatal("Expected busy error, got:", err)
+	}
+	if update.Load() != 1 {
+		t.Fatal("Non-idempotent method retried:", update.Load())
+	}
+}
+
+func TestRetryPolicyPerMethod(t *testing.T) {
+	rpc := NewTestRPC()
+	calls := flaky(rpc, "status", 5)
+	retry := NewRetry(RetryPolicy{MaxAttempts: 10, Backoff: time.Millisecond})
+	retry.SetPolicy("status", RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond})
+	retry.SetIdempotent("status")
+	_, client := NewPeerPair(rpc)
+	client.UseCall(retry.Middleware)
+	if err := client.Call("status", "ok", new(string)); err == nil {
+		t.Fatal("Expected error after attempts ran out")
+	}
+	if calls.Load() != 2 {
+		t.Fatal("Unexpected number of attempts:", calls.Load())
+	}
+}
+
+func TestRetryRespectsDeadline(t *testing.T) {
+	rpc := NewTestRPC()
+	calls := flaky(rpc, "status", 5)
+	retry := NewRetry(RetryPolicy{MaxAttempts: 5, Backoff: time.Second})
+	retry.SetIdempotent("status")
+	_, client := NewPeerPair(rpc)
+	client.UseCall(retry.Middleware)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := client.CallContext(ctx, "status", "ok", new(string))
+	if rpcError, ok := err.(*Error); !ok || rpcError.Code != ErrCodeBusy {
+		t.Fatal("Expected busy error, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond || calls.Load() != 1 {
+		t.Fatal("Retried past the deadline:", elapsed, calls.Load())
+	}
+}
+
+func TestRetryDiscoversIdempotentMethods(t *testing.T) {
+	rpc := NewTestRPC()
+	calls := flaky(rpc, "status", 1, MethodIdempotent())
+	retry := NewRetry(RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond})
+	_, client := NewPeerPair(rpc)
+	Fatal(retry.Discover(context.Background(), client), t)
+	client.UseCall(retry.Middleware)
+	Fatal(client.Call("status", "ok", new(string)), t)
+	if calls.Load() != 2 {
+		t.Fatal("Unexpected number of attempts:", calls.Load())
+	}
+}
+
+func TestRetrySkipsClosedPeer(t *testing.T) {
+	rpc := NewTestRPC()
+	retry := NewRetry(RetryPolicy{MaxAttempts: 3, Backoff: time.Second})
+	retry.SetIdempotent("status")
+	_, client := NewPeerPair(rpc)
+	client.UseCall(retry.Middleware)
+	client.Close()
+	<-client.Done()
+	start := time.Now()
+	if err := client.Call("status", "ok", new(string)); !errors.Is(err, ErrPeerClosed) {
+		t.Fatal("Expected ErrPeerClosed, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatal("Retried a closed peer:", elapsed)
+	}
+}
@@ -0,0 +1,260 @@
+package duplex
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+/*
+Sealing
+
+With the seal feature negotiated, the payload of every request
+and reply is encrypted for the remote, so a hop relaying frames
+between the peers, like a message broker, can route them but not
+read them. Each side offers its X25519 public key and a random
+nonce, base64url encoded, in the handshake:
+
+	SIMPLEX/1.0;json;seal=dGhlIGNsaWVudCdzIHB1YmxpYyBrZXkgYW5kIG5vbmNl...
+	+OK;seal=dGhlIHNlcnZlcidzIHB1YmxpYyBrZXkgYW5kIG5vbmNl...
+
+The peers derive a key for each direction with HKDF-SHA256 from
+their ECDH secret and both nonces, and seal payloads with
+AES-GCM. A sealed payload is the codec's encoding of the original
+payload and ext as a pair, encrypted, behind the 8 byte counter its
+nonce is made from, and replaces both:
+
+	{"type": "req", "method": "send", "id": 3, "payload": "AAAAAAAAAAE5s..."}
+
+Type, method, id, more and any error stay visible, and are
+authenticated with the payload so they can't be changed in
+transit. Counters must increase, so sealed messages can't be
+replayed either. A peer that fails to unseal a message closes
+with ErrSealBroken.
+
+Keys are exchanged with whichever peer answers the handshake. A
+Gateway answers its own, so it unseals what it forwards; peers
+sealing through one run a connection of their own over a stream
+it relays, with HandshakeThrough and AcceptThrough.
+
+Sealing only keeps payloads from a hop if each side knows which
+key to expect. A hop that rewrites handshakes can substitute its
+own keys and read everything, so pin the remote's key, failing
+the handshake with ErrSealKeyRejected if it doesn't match:
+
+	rpc.SetSealing(key, duplex.TrustKeys(serverKey))
+
+Without a verify func any key is accepted, and a warning is
+logged for every connection.
+*/
+
+var (
+	// ErrNotSealed is returned by handshakes with a remote that
+	// doesn't seal when sealing is set.
+	ErrNotSealed = errors.New("duplex: remote does not support " + FeatureSeal)
+	// ErrSealBroken is why a peer closes after a message fails to
+	// unseal.
+	ErrSealBroken = errors.New("duplex: sealed message failed to open")
+	// ErrSealKeyRejected is returned by handshakes whose remote
+	// seal key fails verification.
+	ErrSealKeyRejected = errors.New("duplex: remote seal key rejected")
+)
+
+const sealNonceSize = 16
+
+// SetSealing seals payloads for connections made after the call
+// with key, an X25519 private key, requiring remotes to seal too.
+// verify vets each remote's public key, failing the handshake if
+// it returns an error; pinning keys with TrustKeys is what keeps a
+// hop from substituting its own. A nil verify trusts any key, so
+// payloads are only confidential if the caller checks RemoteKey.
+// A nil key turns sealing off.
+func (rpc *RPC) SetSealing(key *ecdh.PrivateKey, verify func(*ecdh.PublicKey) error) {
+	rpc.Lock()
+	defer rpc.Unlock()
+	rpc.sealKey = key
+	rpc.sealVerify = verify
+}
+
+// TrustKeys returns a verify func for SetSealing trusting only
+// keys.
+func TrustKeys(keys ...*ecdh.PublicKey) func(*ecdh.PublicKey) error {
+	return func(remote *ecdh.PublicKey) error {
+		for _, key := range keys {
+			if remote.Equal(key) {
+				return nil
+			}
+		}
+		return errors.New("untrusted key")
+	}
+}
+
+// sealOffer returns this side's seal feature value, or "" if it
+// doesn't seal. rpc must be locked.
+func (rpc *RPC) sealOffer() string {
+	if rpc.sealKey == nil {
+		return ""
+	}
+	value := append(rpc.sealKey.PublicKey().Bytes(), make([]byte, sealNonceSize)...)
+	rand.Read(value[len(value)-sealNonceSize:])
+	return base64.RawURLEncoding.EncodeToString(value)
+}
+
+// RemoteKey returns the remote's public key if payloads are sealed,
+// and otherwise nil.
+func (peer *Peer) RemoteKey() *ecdh.PublicKey {
+	if peer.sealer == nil {
+		return nil
+	}
+	return peer.sealer.remote
+}
+
+type sealer struct {
+	remote *ecdh.PublicKey
+	send   cipher.AEAD
+	recv   cipher.AEAD
+
+	mu       sync.Mutex // held from sealing until written, so counters go out in order
+	sent     uint64
+	received uint64 // used only by the route loop
+}
+
+// negotiateSeal derives the keys sealing payloads from this side's
+// and the remote's seal feature values.
+func (peer *Peer) negotiateSeal(local, remote string) error {
+	peer.rpc.Lock()
+	key, verify := peer.rpc.sealKey, peer.rpc.sealVerify
+	peer.rpc.Unlock()
+	localValue, err := base64.RawURLEncoding.DecodeString(local)
+	if err != nil || key == nil || len(localValue) != 32+sealNonceSize ||
+		!bytes.Equal(localValue[:32], key.PublicKey().Bytes()) {
+		return errors.New("duplex: seal key changed during handshake")
+	}
+	remoteValue, err := base64.RawURLEncoding.DecodeString(remote)
+	if err != nil || len(remoteValue) != 32+sealNonceSize {
+		return errors.New("duplex: malformed remote seal key")
+	}
+	remoteKey, err := ecdh.X25519().NewPublicKey(remoteValue[:32])
+	if err != nil {
+		return err
+	}
+	if verify == nil {
+		peer.log().Warn("sealing without verifying the remote key")
+	} else if err := verify(remoteKey); err != nil {
+		return fmt.Errorf("%w: %v", ErrSealKeyRejected, err)
+	}
+	secret, err := key.ECDH(remoteKey)
+	if err != nil {
+		return err
+	}
+	clientNonce, serverNonce := localValue[32:], remoteValue[32:]
+	if !peer.client {
+		clientNonce, serverNonce = serverNonce, clientNonce
+	}
+	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+	toServer, err := sealCipher(secret, salt, "duplex seal client")
+	if err != nil {
+		return err
+	}
+	toClient, err := sealCipher(secret, salt, "duplex seal server")
+	if err != nil {
+		return err
+	}
+	peer.sealer = &sealer{remote: remoteKey, send: toServer, recv: toClient}
+	if !peer.client {
+		peer.sealer.send, peer.sealer.recv = toClient, toServer
+	}
+	return nil
+}
+
+func sealCipher(secret, salt []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealed reports whether msg's payload is sealed when sealing.
+func sealed(msg *Message) bool {
+	return msg.Type == TypeRequest || msg.Type == TypeReply
+}
+
+// sealData returns the visible parts of msg that its sealed
+// payload vouches for.
+func sealData(msg *Message) []byte {
+	data := []byte(msg.Type + "\x00" + msg.Method + "\x00")
+	data = strconv.AppendInt(data, int64(msg.Id), 10)
+	data = strconv.AppendBool(append(data, 0), msg.More)
+	if msg.Error != nil {
+		data = strconv.AppendInt(append(data, 0), int64(msg.Error.Code), 10)
+		data = append(append(data, 0), msg.Error.Message...)
+	}
+	return data
+}
+
+// seal returns a copy of msg with its payload sealed. sealer.mu
+// must be held.
+func (peer *Peer) seal(msg *Message) (*Message, error) {
+	plain, err := peer.rpc.codec.Encode([]interface{}{msg.Payload, msg.Ext})
+	if err != nil {
+		return nil, err
+	}
+	s := peer.sealer
+	s.sent++
+	nonce := make([]byte, s.send.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], s.sent)
+	data := make([]byte, 8, 8+len(plain)+s.send.Overhead())
+	copy(data, nonce[len(nonce)-8:])
+	sealedMsg := *msg
+	sealedMsg.Payload = s.send.Seal(data, nonce, plain, sealData(msg))
+	sealedMsg.Ext = nil
+	return &sealedMsg, nil
+}
+
+// unseal replaces msg's sealed payload with the original payload
+// and ext.
+func (peer *Peer) unseal(msg *Message) error {
+	// the codec decoded the sealed bytes generically, so convert
+	// them through it
+	frame, err := peer.rpc.codec.Encode(msg.Payload)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if err := peer.rpc.codec.Decode(frame, &data); err != nil || len(data) < 8 {
+		return ErrSealBroken
+	}
+	s := peer.sealer
+	counter := binary.BigEndian.Uint64(data[:8])
+	if counter <= s.received {
+		return ErrSealBroken
+	}
+	nonce := make([]byte, s.recv.NonceSize())
+	copy(nonce[len(nonce)-8:], data[:8])
+	plain, err := s.recv.Open(nil, nonce, data[8:], sealData(msg))
+	if err != nil {
+		return ErrSealBroken
+	}
+	s.received = counter
+	var parts []interface{}
+	if err := peer.rpc.codec.Decode(plain, &parts); err != nil || len(parts) != 2 {
+		return ErrSealBroken
+	}
+	msg.Payload, msg.Ext = parts[0], parts[1]
+	return nil
+}
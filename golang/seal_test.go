@@ -0,0 +1,244 @@
+package duplex
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func NewSealingRPC(t *testing.T) (*RPC, *ecdh.PrivateKey) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	Fatal(err, t)
+	rpc := NewTestRPC()
+	rpc.SetSealing(key, nil)
+	rpc.Register("echo", Echo)
+	return rpc, key
+}
+
+// frameRelay forwards frames between two conns like a broker would,
+// recording them and passing each through tamper.
+type frameRelay struct {
+	mu     sync.Mutex
+	frames []string
+	tamper func(string) string
+}
+
+func (r *frameRelay) pipe(from, to *MockConn) {
+	buf := make([]byte, MaxFrameSize)
+	for {
+		n, err := from.Read(buf)
+		if err != nil {
+			to.Close()
+			return
+		}
+		frame := string(buf[:n])
+		r.mu.Lock()
+		r.frames = append(r.frames, frame)
+		if r.tamper != nil {
+			frame = r.tamper(frame)
+		}
+		r.mu.Unlock()
+		to.Write([]byte(frame))
+	}
+}
+
+// NewRelayedPeers connects a client of clientRPC to serverRPC
+// through a relay.
+func NewRelayedPeers(clientRPC, serverRPC *RPC, r *frameRelay) (*Peer, *Peer, error) {
+	client, relay1 := NewConnPair()
+	relay2, server := NewConnPair()
+	go r.pipe(relay1, relay2)
+	go r.pipe(relay2, relay1)
+	var serverPeer *Peer
+	var serverErr error
+	done := make(chan struct{})
+	go func() {
+		serverPeer, serverErr = serverRPC.Accept(server)
+		close(done)
+	}()
+	clientPeer, err := clientRPC.Handshake(client)
+	<-done
+	if err == nil {
+		err = serverErr
+	}
+	return serverPeer, clientPeer, err
+}
+
+func TestSealingThroughRelay(t *testing.T) {
+	clientRPC, clientKey := NewSealingRPC(t)
+	serverRPC, serverKey := NewSealingRPC(t)
+	r := &frameRelay{}
+	server, client, err := NewRelayedPeers(clientRPC, serverRPC, r)
+	Fatal(err, t)
+	if !client.RemoteKey().Equal(serverKey.PublicKey()) || !server.RemoteKey().Equal(clientKey.PublicKey()) {
+		t.Fatal("Unexpected remote keys")
+	}
+	var reply string
+	Fatal(client.Call("echo", "top secret", &reply), t)
+	if reply != "top secret" {
+		t.Fatal("Unexpected reply:", reply)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, frame := range r.frames[2:] {
+		if strings.Contains(frame, "secret") {
+			t.Fatal("Relay saw payload:", frame)
+		}
+		if !strings.Contains(frame, `"method":"echo"`) {
+			t.Fatal("Relay can't see method:", frame)
+		}
+	}
+}
+
+func TestSealingDetectsTampering(t *testing.T) {
+	clientRPC, _ := NewSealingRPC(t)
+	serverRPC, _ := NewSealingRPC(t)
+	serverRPC.Register("echo2", Echo)
+	r := &frameRelay{tamper: func(frame string) string {
+		return strings.Replace(frame, `"method":"echo"`, `"method":"echo2"`, 1)
+	}}
+	server, client, err := NewRelayedPeers(clientRPC, serverRPC, r)
+	Fatal(err, t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.CallContext(ctx, "echo", "hi", new(string)); err == nil {
+		t.Fatal("Expected tampered call to fail")
+	}
+	<-server.Done()
+	if !errors.Is(server.Err(), ErrSealBroken) {
+		t.Fatal("Expected seal broken, got:", server.Err())
+	}
+}
+
+func TestSealingProtectsExt(t *testing.T) {
+	clientRPC, _ := NewSealingRPC(t)
+	serverRPC, _ := NewSealingRPC(t)
+	exts := make(chan interface{}, 1)
+	serverRPC.Register("ext", func(ch *Channel) error {
+		exts <- ch.getExt()
+		return Echo(ch)
+	})
+	r := &frameRelay{tamper: func(frame string) string {
+		return strings.Replace(frame, `{"type":"req"`, `{"ext":"forged","type":"req"`, 1)
+	}}
+	_, client, err := NewRelayedPeers(clientRPC, serverRPC, r)
+	Fatal(err, t)
+	ch := client.Open("ext")
+	ch.SetExt("trace-1")
+	Fatal(ch.Send("hi", false), t)
+	_, err = ch.Recv(new(string))
+	Fatal(err, t)
+	if ext := <-exts; ext != "trace-1" {
+		t.Fatal("Unexpected ext:", ext)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, frame := range r.frames {
+		if strings.Contains(frame, "trace-1") {
+			t.Fatal("Relay saw ext:", frame)
+		}
+	}
+}
+
+func TestSealingRejectsReplay(t *testing.T) {
+	rpc, _ := NewSealingRPC(t)
+	server, client := NewPeerPair(rpc)
+	client.sealer.mu.Lock()
+	msg, err := client.seal(&Message{Type: TypeRequest, Method: "echo", Id: 7, Payload: "hi"})
+	client.sealer.mu.Unlock()
+	Fatal(err, t)
+	replay := *msg
+	Fatal(server.unseal(msg), t)
+	if msg.Payload != "hi" {
+		t.Fatal("Unexpected payload:", msg.Payload)
+	}
+	if err := server.unseal(&replay); err != ErrSealBroken {
+		t.Fatal("Expected replay to fail, got:", err)
+	}
+}
+
+func TestSealingRequiredByClient(t *testing.T) {
+	conn := NewMockConn()
+	defer conn.Close()
+	rpc, _ := NewSealingRPC(t)
+	conn.inbox <- HandshakeAccept
+	if _, err := rpc.Handshake(conn); err != ErrNotSealed {
+		t.Fatal("Expected not sealed error, got:", err)
+	}
+	if !strings.HasPrefix(conn.sent[0].String(), Handshake("json")+";seal=") {
+		t.Fatal("Unexpected handshake frame:", conn.sent[0].String())
+	}
+}
+
+func TestSealingRequiredByServer(t *testing.T) {
+	conn := NewMockConn()
+	rpc, _ := NewSealingRPC(t)
+	conn.inbox <- Handshake("json")
+	if _, err := rpc.Accept(conn); err != ErrNotSealed {
+		t.Fatal("Expected not sealed error, got:", err)
+	}
+}
+
+func TestSealingRejectsUntrustedKey(t *testing.T) {
+	clientRPC, _ := NewSealingRPC(t)
+	serverRPC, serverKey := NewSealingRPC(t)
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	Fatal(err, t)
+	clientKey := clientRPC.sealKey
+	clientRPC.SetSealing(clientKey, TrustKeys(other.PublicKey()))
+	if _, _, err := NewRelayedPeers(clientRPC, serverRPC, &frameRelay{}); !errors.Is(err, ErrSealKeyRejected) {
+		t.Fatal("Expected seal key rejected, got:", err)
+	}
+	clientRPC.SetSealing(clientKey, TrustKeys(other.PublicKey(), serverKey.PublicKey()))
+	_, _, err = NewRelayedPeers(clientRPC, serverRPC, &frameRelay{})
+	Fatal(err, t)
+}
+
+func TestSealingWithoutVerifyWarns(t *testing.T) {
+	var logs logBuffer
+	rpc, _ := NewSealingRPC(t)
+	rpc.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	NewPeerPair(rpc)
+	if line := logLine(logs.String(), `"sealing without verifying the remote key"`); !strings.Contains(line, "level=WARN") {
+		t.Fatal("Expected warning in logs:", logs.String())
+	}
+}
+
+func TestSealingThroughGateway(t *testing.T) {
+	gw := NewGateway(NewTestRPC())
+	alice, _ := gatewayClient(t, gw)
+	bob, _ := gatewayClient(t, gw)
+	aliceRPC, aliceKey := NewSealingRPC(t)
+	bobRPC, bobKey := NewSealingRPC(t)
+	aliceRPC.SetSealing(aliceKey, TrustKeys(bobKey.PublicKey()))
+	bobRPC.SetSealing(bobKey, TrustKeys(aliceKey.PublicKey()))
+	alice.Register("connect", aliceRPC.AcceptThrough())
+	Fatal(alice.Call("gateway.register", "alice", new(interface{})), t)
+
+	peer, err := bobRPC.HandshakeThrough(bob, "alice.connect")
+	Fatal(err, t)
+	if !peer.RemoteKey().Equal(aliceKey.PublicKey()) {
+		t.Fatal("Expected alice's key, got:", peer.RemoteKey())
+	}
+	var reply string
+	Fatal(peer.Call("echo", "top secret", &reply), t)
+	if reply != "top secret" {
+		t.Fatal("Unexpected reply:", reply)
+	}
+
+	// any other key, like one a hop substituted, is refused
+	eveRPC, _ := NewSealingRPC(t)
+	alice.Register("eve", eveRPC.AcceptThrough())
+	if _, err := bobRPC.HandshakeThrough(bob, "alice.eve"); !errors.Is(err, ErrSealKeyRejected) {
+		t.Fatal("Expected seal key rejected, got:", err)
+	}
+	peer.Close()
+	<-peer.Done()
+}
@@ -0,0 +1,88 @@
+package duplex
+
+import (
+	"golang.org/x/net/context"
+)
+
+/*
+Shutdown
+
+Shutdown first sends a TypeGoAway message so the remote stops
+making calls, then refuses new inbound requests with
+ErrCodeShuttingDown while in-flight work drains:
+
+	{"type": "goaway"}
+
+Implementations that don't know the message will reject it,
+which is harmless since the connection is about to close.
+*/
+
+// Shutdown gracefully closes the peer. It tells the remote it's
+// going away, refuses new inbound requests and waits for running
+// handlers and pending replies before closing the connection. If
+// ctx expires first, the connection is closed anyway and the
+// context's error returned.
+func (peer *Peer) Shutdown(ctx context.Context) error {
+	peer.mu.Lock()
+	first := !peer.draining
+	peer.draining = true
+	peer.checkDrained()
+	peer.mu.Unlock()
+	if first {
+		peer.log().Info("shutting down")
+		if err := peer.writeMsg(&Message{Type: TypeGoAway}); err != nil {
+			peer.log().Error("unable to send goaway", "err", err)
+		}
+	}
+	select {
+	case <-peer.drained:
+		return peer.Close()
+	case <-ctx.Done():
+		peer.Close()
+		return ctx.Err()
+	}
+}
+
+// checkDrained signals Shutdown once nothing is in flight.
+// It must be called with peer.mu held.
+func (peer *Peer) checkDrained() {
+	if !peer.draining || peer.active > 0 || len(peer.repCh) > 0 {
+		return
+	}
+	select {
+	case <-peer.drained:
+	default:
+		close(peer.drained)
+	}
+}
+
+func (peer *Peer) goAway() {
+	peer.log().Info("remote going away")
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.goingAway = true
+}
+
+// opening refuses the first message of an outbound call once the
+// remote has said it's going away or the peer has closed.
+func (ch *Channel) opening() error {
+	ch.mu.Lock()
+	first := !ch.opened
+	ch.opened = true
+	ch.mu.Unlock()
+	if !first {
+		return nil
+	}
+	ch.Peer.mu.Lock()
+	refused, closeErr := ch.goingAway, ch.closeErr
+	ch.Peer.mu.Unlock()
+	if closeErr != nil {
+		return closeErr
+	}
+	if refused {
+		ch.untrack(ch.repCh, ch)
+		ch.revokeCallbacks()
+		return &Error{Code: ErrCodeShuttingDown, Message: "remote shutting down"}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package duplex
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(1 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsHandlers(t *testing.T) {
+	rpc := NewTestRPC()
+	started := make(chan bool)
+	release := make(chan bool)
+	rpc.Register("slow", func(ch *Channel) error {
+		started <- true
+		<-release
+		return Echo(ch)
+	})
+	server, client := NewPeerPair(rpc)
+	called := make(chan error)
+	go func() {
+		var reply string
+		called <- client.Call("slow", "done", &reply)
+	}()
+	<-started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	waitFor(t, func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.goingAway
+	})
+	err := client.Call("slow", "refused", new(string))
+	if rpcError, ok := err.(*Error); !ok || rpcError.Code != ErrCodeShuttingDown {
+		t.Fatal("Expected shutting down error, got:", err)
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned with a handler still running")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	Fatal(<-called, t)
+	Fatal(<-shutdown, t)
+	if !server.conn.(*MockConn).closed {
+		t.Fatal("Connection not closed after shutdown")
+	}
+}
+
+func TestShutdownRefusesNewRequests(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("echo", Echo)
+	server, client := NewPeerPair(rpc)
+	server.mu.Lock()
+	server.draining = true
+	server.mu.Unlock()
+	err := client.Call("echo", "hello", new(string))
+	if rpcError, ok := err.(*Error); !ok || rpcError.Code != ErrCodeShuttingDown {
+		t.Fatal("Expected shutting down error, got:", err)
+	}
+}
+
+func TestShutdownContextExpires(t *testing.T) {
+	rpc := NewTestRPC()
+	started := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	rpc.Register("stuck", func(ch *Channel) error {
+		started <- true
+		<-release
+		return nil
+	})
+	server, client := NewPeerPair(rpc)
+	client.Open("stuck").Send(nil, false)
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected deadline exceeded, got:", err)
+	}
+	if !server.conn.(*MockConn).closed {
+		t.Fatal("Connection not closed after shutdown")
+	}
+}
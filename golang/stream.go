@@ -0,0 +1,108 @@
+package duplex
+
+import (
+	"iter"
+)
+
+/*
+Streams
+
+A streaming reply is a run of messages with more set, closed by
+one without it. The last message may carry a final value or be
+empty, so consumers treat an empty payload as no value:
+
+	<- {"id": 1, "payload": 1, "more": true}
+	<- {"id": 1, "payload": 2, "more": true}
+	<- {"id": 1}
+*/
+
+// Stream returns an iterator over the values received on ch, each
+// decoded into a T. It ends after the last message of the stream,
+// or yields the zero T with the error that ended it early. Breaking
+// out of the loop abandons the rest of the stream, which is dropped
+// as it arrives.
+func Stream[T any](ch *Channel) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for {
+			var zero T
+			msg, err := ch.recvMsg()
+			if msg == nil {
+				if err != nil {
+					yield(zero, err)
+				}
+				return
+			}
+			if msg.Payload != nil {
+				value := zero
+				if err := ch.decode(msg.Payload, &value); err != nil {
+					if msg.More {
+						ch.abandon()
+					}
+					yield(zero, err)
+					return
+				}
+				if !yield(value, nil) {
+					if msg.More {
+						ch.abandon()
+					}
+					return
+				}
+			}
+			if !msg.More {
+				return
+			}
+		}
+	}
+}
+
+// SendAll streams every value of seq on ch, then ends the stream.
+func SendAll[T any](ch *Channel, seq iter.Seq[T]) error {
+	for value := range seq {
+		if err := ch.Send(value, true); err != nil {
+			return err
+		}
+	}
+	return ch.Send(nil, false)
+}
+
+// RegisterStream registers a handler that calls fn with the request
+// arguments and streams the values of the iterator it returns.
+func RegisterStream[T any](rpc *RPC, name string, fn func(interface{}, *Channel) (iter.Seq[T], error), opts ...MethodOption) {
+	rpc.Register(name, func(ch *Channel) error {
+		var args interface{}
+		if _, err := ch.Recv(&args); err != nil {
+			return err
+		}
+		seq, err := fn(args, ch)
+		if err != nil {
+			return err
+		}
+		return SendAll(ch, seq)
+	}, append([]MethodOption{MethodStreaming(false, true)}, opts...)...)
+}
+
+// RegisterChan is like RegisterStream for handlers that produce
+// their values on a channel. The stream ends when it's closed. If
+// sending fails, the rest of the values are read and dropped, so
+// the producer should still close the channel.
+func RegisterChan[T any](rpc *RPC, name string, fn func(interface{}, *Channel) (<-chan T, error), opts ...MethodOption) {
+	RegisterStream(rpc, name, func(args interface{}, ch *Channel) (iter.Seq[T], error) {
+		values, err := fn(args, ch)
+		if err != nil {
+			return nil, err
+		}
+		return func(yield func(T) bool) {
+			for value := range values {
+				if !yield(value) {
+					// the stream failed, but the producer may
+					// still be sending
+					go func() {
+						for range values {
+						}
+					}()
+					return
+				}
+			}
+		}, nil
+	}, opts...)
+}
@@ -0,0 +1,145 @@
+package duplex
+
+import (
+	"iter"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStreamDecodesValues(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("count", Generator)
+	client, _ := NewPeerPair(rpc)
+	ch := client.Open("count")
+	Fatal(ch.Send(3, false), t)
+	var nums []float64
+	for value, err := range Stream[struct{ Num float64 }](ch) {
+		Fatal(err, t)
+		nums = append(nums, value.Num)
+	}
+	if !slices.Equal(nums, []float64{1, 2, 3}) {
+		t.Fatal("Unexpected values:", nums)
+	}
+}
+
+func TestStreamEndsWithError(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.Register("errorInStream", GeneratorThatErrorsAfterSecond)
+	client, _ := NewPeerPair(rpc)
+	ch := client.Open("errorInStream")
+	Fatal(ch.Send(5, false), t)
+	var values int
+	var last error
+	for _, err := range Stream[map[string]interface{}](ch) {
+		if err != nil {
+			last = err
+			continue
+		}
+		values++
+	}
+	if rpcError, ok := last.(*Error); !ok || rpcError.Code != TestErrorCode {
+		t.Fatal("Expected stream error, got:", last)
+	}
+	if values != 2 {
+		t.Fatal("Unexpected number of values:", values)
+	}
+}
+
+func TestRegisterStream(t *testing.T) {
+	rpc := NewTestRPC()
+	RegisterStream(rpc, "letters", func(args interface{}, ch *Channel) (iter.Seq[string], error) {
+		return slices.Values([]string{"a", "b", "c"}), nil
+	})
+	RegisterChan(rpc, "squares", func(args interface{}, ch *Channel) (<-chan float64, error) {
+		n := int(args.(float64))
+		values := make(chan float64)
+		go func() {
+			defer close(values)
+			for i := 1; i <= n; i++ {
+				values <- float64(i * i)
+			}
+		}()
+		return values, nil
+	})
+	client, _ := NewPeerPair(rpc)
+
+	ch := client.Open("letters")
+	Fatal(ch.Send(nil, false), t)
+	var letters []string
+	for value, err := range Stream[string](ch) {
+		Fatal(err, t)
+		letters = append(letters, value)
+	}
+	if !slices.Equal(letters, []string{"a", "b", "c"}) {
+		t.Fatal("Unexpected letters:", letters)
+	}
+
+	ch = client.Open("squares")
+	Fatal(ch.Send(4, false), t)
+	var squares []float64
+	for value, err := range Stream[float64](ch) {
+		Fatal(err, t)
+		squares = append(squares, value)
+	}
+	if !slices.Equal(squares, []float64{1, 4, 9, 16}) {
+		t.Fatal("Unexpected squares:", squares)
+	}
+}
+
+func TestStreamBreakDropsRest(t *testing.T) {
+	rpc := NewTestRPC()
+	RegisterStream(rpc, "numbers", func(args interface{}, ch *Channel) (iter.Seq[int], error) {
+		return func(yield func(int) bool) {
+			for i := 0; i < 3000 && yield(i); i++ {
+			}
+		}, nil
+	})
+	rpc.Register("echo", Echo)
+	_, client := NewPeerPair(rpc)
+	ch := client.Open("numbers")
+	Fatal(ch.Send(nil, false), t)
+	for _, err := range Stream[int](ch) {
+		Fatal(err, t)
+		break
+	}
+	called := make(chan error, 1)
+	go func() {
+		called <- client.Call("echo", "still routing", new(string))
+	}()
+	select {
+	case err := <-called:
+		Fatal(err, t)
+	case <-time.After(1 * time.Second):
+		t.Fatal("Call blocked behind the abandoned stream")
+	}
+}
+
+func TestRegisterChanProducerFinishesWhenStreamFails(t *testing.T) {
+	rpc := NewTestRPC()
+	rpc.SetWindow(2)
+	finished := make(chan bool)
+	RegisterChan(rpc, "ticks", func(args interface{}, ch *Channel) (<-chan int, error) {
+		values := make(chan int)
+		go func() {
+			defer close(finished)
+			defer close(values)
+			for i := 0; i < 100; i++ {
+				values <- i
+			}
+		}()
+		return values, nil
+	})
+	_, client := NewPeerPair(rpc)
+	ch := client.Open("ticks")
+	Fatal(ch.Send(nil, false), t)
+	for _, err := range Stream[int](ch) {
+		Fatal(err, t)
+		break
+	}
+	select {
+	case <-finished:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Producer blocked after the stream failed")
+	}
+}
@@ -0,0 +1,123 @@
+package duplex
+
+import (
+	"io"
+	"net"
+)
+
+/*
+Tunneling
+
+A tunnel is a streaming call whose payloads are the bytes of a
+connection, as read and written by Channel.Read and Write. The
+forwarding side opens the stream with an empty message so the
+remote handler can dial before the local connection has said
+anything, then each side closes its half of the stream when its
+connection stops sending.
+
+A peer connection can be tunneled the same way, with each of its
+frames carried whole as one payload. Peers that can only reach
+each other through a hop, like a Gateway, can run a connection
+of their own over a stream the hop relays, so features like
+sealing are negotiated end to end:
+
+	alice.Register("connect", rpc.AcceptThrough())
+	peer, err := rpc.HandshakeThrough(bob, "alice.connect")
+*/
+
+// ForwardListener accepts connections from listener and forwards
+// each over a new stream to method on peer, typically a handler
+// made with ForwardDialer. It returns when Accept fails.
+func ForwardListener(peer *Peer, method string, listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			ch := peer.Open(method)
+			if err := ch.Send(nil, true); err != nil {
+				peer.log().Error("unable to open tunnel",
+					"method", method, "err", err)
+				conn.Close()
+				return
+			}
+			if err := splice(ch, conn); err != nil {
+				peer.log().Warn("tunnel closed",
+					"method", method, "id", ch.id, "err", err)
+			}
+		}()
+	}
+}
+
+// ForwardDialer returns a handler that dials address for every
+// tunnel opened to it and splices the connection onto the stream.
+func ForwardDialer(network, address string) func(*Channel) error {
+	return func(ch *Channel) error {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return ch.SendErr(ErrCodeInternal, err.Error(), nil)
+		}
+		return splice(ch, conn)
+	}
+}
+
+// HandshakeThrough connects this RPC to the one serving method on
+// peer's remote, or on a peer beyond it, over a stream opened to
+// method. The method's handler is made by AcceptThrough.
+func (rpc *RPC) HandshakeThrough(peer *Peer, method string) (*Peer, error) {
+	ch := peer.Open(method)
+	tunneled, err := rpc.Handshake(ch)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return tunneled, nil
+}
+
+// AcceptThrough returns a handler accepting connections made to
+// this RPC with HandshakeThrough. The handler returns once the
+// connection closes.
+func (rpc *RPC) AcceptThrough() func(*Channel) error {
+	return func(ch *Channel) error {
+		peer, err := rpc.Accept(ch)
+		if err != nil {
+			ch.Close()
+			return err
+		}
+		<-peer.Done()
+		return ch.Close()
+	}
+}
+
+// splice copies between ch and conn in both directions until both
+// are done, then closes conn. A side that ends cleanly half closes
+// the other; an error closes conn outright so neither copy hangs.
+func splice(ch *Channel, conn net.Conn) error {
+	errs := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(ch, conn)
+		if closeErr := ch.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			conn.Close()
+		}
+		errs <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, ch)
+		if hc, ok := conn.(interface{ CloseWrite() error }); ok && err == nil {
+			hc.CloseWrite()
+		} else {
+			conn.Close()
+		}
+		errs <- err
+	}()
+	err := <-errs
+	if err2 := <-errs; err == nil {
+		err = err2
+	}
+	conn.Close()
+	return err
+}
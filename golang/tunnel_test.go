@@ -0,0 +1,124 @@
+package duplex
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func echoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatal(err, t)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestForwardListener(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	rpc := NewTestRPC()
+	rpc.Register("tunnel", ForwardDialer("tcp", target.Addr().String()))
+	client, _ := NewPeerPair(rpc)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatal(err, t)
+	defer listener.Close()
+	go ForwardListener(client, "tunnel", listener)
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Fatal(err, t)
+		_, err = conn.Write([]byte("hello through the tunnel\n"))
+		Fatal(err, t)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		Fatal(err, t)
+		if line != "hello through the tunnel\n" {
+			t.Fatal("Unexpected echo:", line)
+		}
+		conn.(*net.TCPConn).CloseWrite()
+		rest, err := io.ReadAll(conn)
+		Fatal(err, t)
+		if len(rest) != 0 {
+			t.Fatal("Unexpected trailing bytes:", rest)
+		}
+		conn.Close()
+	}
+}
+
+func TestForwardTargetClosesFirstWithFlow(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatal(err, t)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("bye\n"))
+			conn.Close()
+		}
+	}()
+	rpc := NewTestRPC()
+	rpc.SetWindow(2)
+	rpc.Register("tunnel", ForwardDialer("tcp", target.Addr().String()))
+	client, _ := NewPeerPair(rpc)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatal(err, t)
+	defer listener.Close()
+	go ForwardListener(client, "tunnel", listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	Fatal(err, t)
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	Fatal(err, t)
+	if line != "bye\n" {
+		t.Fatal("Unexpected greeting:", line)
+	}
+	// keep writing after the target has gone until the tunnel
+	// closes the connection
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	chunk := make([]byte, 1024)
+	for {
+		if _, err = conn.Write(chunk); err != nil {
+			break
+		}
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("Tunnel hung after the target closed")
+	}
+}
+
+func TestForwardDialFailureClosesConn(t *testing.T) {
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatal(err, t)
+	addr := unused.Addr().String()
+	unused.Close()
+	rpc := NewTestRPC()
+	rpc.Register("tunnel", ForwardDialer("tcp", addr))
+	client, _ := NewPeerPair(rpc)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatal(err, t)
+	defer listener.Close()
+	go ForwardListener(client, "tunnel", listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	Fatal(err, t)
+	defer conn.Close()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal("Expected connection to be closed, got:", err)
+	}
+}